@@ -2,6 +2,7 @@ package conveyor
 
 import (
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -51,6 +52,58 @@ AND sha = ?
 ORDER BY seq desc
 LIMIT 1`
 	var a Artifact
-	err := tx.Get(&a, tx.Rebind(sql), parts[0], parts[1])
+	err := tx.Get(&a, tx.Rebind(sql), parts[0], normalizeSha(parts[1]))
 	return &a, err
 }
+
+// BuildArtifact is a file that a build produced, like a binary or a log, that
+// lives outside of conveyor. Unlike an Artifact, failed builds can have them.
+type BuildArtifact struct {
+	// Unique identifier for this build artifact.
+	ID string `db:"id" json:"id"`
+	// Autogenerated sequence id.
+	Seq int64 `db:"seq" json:"seq"`
+	// The build that produced this file.
+	BuildID string `db:"build_id" json:"build_id"`
+	// The name of the file.
+	Name string `db:"name" json:"name"`
+	// Where the file can be downloaded from.
+	URL string `db:"url" json:"url"`
+	// The size of the file, in bytes.
+	SizeBytes int64 `db:"size_bytes" json:"size_bytes"`
+	// The MIME type of the file.
+	ContentType string `db:"content_type" json:"content_type"`
+	// The time that the file was added to the build.
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// buildsAddArtifact links a file to a build. Files can be added to builds in
+// any state.
+func buildsAddArtifact(tx *sqlx.Tx, a *BuildArtifact) error {
+	const createBuildArtifactSql = `INSERT INTO build_artifacts (build_id, name, url, size_bytes, content_type) VALUES (:build_id, :name, :url, :size_bytes, :content_type) RETURNING id, seq, created_at`
+	return insert(tx, createBuildArtifactSql, a, &a.ID, &a.Seq, &a.CreatedAt)
+}
+
+// buildsArtifacts returns the files that a build produced, in the order they
+// were added.
+func buildsArtifacts(tx *sqlx.Tx, buildID string) ([]*BuildArtifact, error) {
+	const sql = `SELECT * FROM build_artifacts WHERE build_id = ? ORDER BY seq`
+	var artifacts []*BuildArtifact
+	err := tx.Select(&artifacts, tx.Rebind(sql), buildID)
+	return artifacts, err
+}
+
+// buildsByArtifactURL finds the build that produced the build artifact with the
+// given url. If there's no such artifact, ErrBuildNotFound is returned.
+func buildsByArtifactURL(tx *sqlx.Tx, url string) (*Build, error) {
+	const sql = `SELECT builds.* FROM builds
+JOIN build_artifacts ON build_artifacts.build_id = builds.id
+WHERE build_artifacts.url = ?
+ORDER BY build_artifacts.seq desc
+LIMIT 1`
+	var b Build
+	if err := tx.Get(&b, tx.Rebind(sql), url); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
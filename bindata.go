@@ -1,6 +1,13 @@
 // Code generated by go-bindata.
 // sources:
 // db/migrations/1_initial_schema.sql
+// db/migrations/2_build_failures.sql
+// db/migrations/3_idempotency_key.sql
+// db/migrations/4_lowercase_shas.sql
+// db/migrations/5_build_retries.sql
+// db/migrations/6_completed_after_started.sql
+// db/migrations/7_build_artifacts.sql
+// db/migrations/8_normalize_branches.sql
 // DO NOT EDIT!
 
 package conveyor
@@ -88,6 +95,146 @@ func dbMigrations1_initial_schemaSql() (*asset, error) {
 	return a, nil
 }
 
+var _dbMigrations2_build_failuresSql = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\xd2\xd5\x55\xd0\xce\xcd\x4c\x2f\x4a\x2c\x49\x55\x08\x2d\xe0\x72\xf4\x09\x71\x0d\x52\x08\x71\x74\xf2\x71\x55\x48\x2a\xcd\xcc\x49\x29\x56\x70\x74\x71\x51\x70\xf6\xf7\x09\xf5\xf5\x53\x48\x4b\xcc\xcc\x29\x2d\x4a\x8d\x2f\x4a\x4d\x2c\xce\xcf\x53\x28\x49\xad\x28\xb1\x26\xa0\x25\xb5\xa8\x28\xbf\x08\xaa\x92\x0b\xd9\x32\x97\xfc\xf2\x3c\x6c\x7a\x5d\x82\xfc\x03\x50\x34\x5b\x13\x52\x85\xea\x2a\x6b\x2e\xc0\x00\x75\x3d\x93\x25\xd3\x00\x00\x00")
+
+func dbMigrations2_build_failuresSqlBytes() ([]byte, error) {
+	return bindataRead(
+		_dbMigrations2_build_failuresSql,
+		"db/migrations/2_build_failures.sql",
+	)
+}
+
+func dbMigrations2_build_failuresSql() (*asset, error) {
+	bytes, err := dbMigrations2_build_failuresSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "db/migrations/2_build_failures.sql", size: 211, mode: os.FileMode(420), modTime: time.Unix(1791986516, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
+var _dbMigrations3_idempotency_keySql = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x7c\x90\xcb\x4a\xc4\x30\x14\x86\xf7\x79\x8a\x7f\xa9\x48\x7c\x81\xae\x32\x93\x20\x85\x9a\x6a\x6d\xc0\xdd\x90\x69\x0f\x33\xc1\x5e\xc6\xf4\x94\xda\xb7\x17\x2d\x5e\x28\x65\xd6\xe7\xff\xce\x7f\x91\x12\x77\x6d\x38\x45\xcf\x04\x77\x11\x2a\x2b\x4d\x81\x52\xed\x32\x83\xe3\x18\x9a\x7a\x80\xd2\x1a\xfb\x3c\x73\x8f\x16\xa1\xa6\xf6\xd2\x33\x75\xd5\x7c\x78\xa3\x19\x4c\x1f\x9c\x08\x21\x25\x76\x8b\xb6\x8a\xe4\x99\x6a\x4c\x81\xcf\xe0\x33\x61\xf0\x2d\xfd\xc7\xf0\x85\xf9\x48\x7f\xc7\xa6\x3f\x85\xca\x37\x8b\xdb\xbd\xd8\x17\x46\x95\x06\xce\xa6\xcf\xce\x20\xb5\xda\xbc\x62\xec\xc2\xfb\x48\x87\xb5\x7b\x6e\x7f\x22\xba\x97\xd4\x3e\xe0\xc8\x91\x08\x37\x2b\xd9\xed\x12\xf0\xb7\xa4\xee\xa7\x4e\xe8\x22\x7f\xba\xfa\x3c\xd9\x5a\xe2\x9b\xda\x9e\x22\x11\x9f\x03\x00\x51\xcf\xca\x16\x49\x01\x00\x00")
+
+func dbMigrations3_idempotency_keySqlBytes() ([]byte, error) {
+	return bindataRead(
+		_dbMigrations3_idempotency_keySql,
+		"db/migrations/3_idempotency_key.sql",
+	)
+}
+
+func dbMigrations3_idempotency_keySql() (*asset, error) {
+	bytes, err := dbMigrations3_idempotency_keySqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "db/migrations/3_idempotency_key.sql", size: 329, mode: os.FileMode(420), modTime: time.Unix(1791986701, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
+var _dbMigrations4_lowercase_shasSql = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x84\x92\x41\x8f\xa2\x30\x18\x86\xef\xfd\x15\xef\x4d\xc9\x0a\xc9\x9e\x75\x4d\xc8\xca\x66\x4d\x76\x75\x22\x98\x99\x9b\xe9\xd0\x22\x5f\x52\x5b\x87\x16\xc9\xfc\xfb\x49\x0b\x08\xb7\xb9\xc1\xc7\xfb\x3e\x3c\xfd\xd2\x38\xc6\x8f\x1b\x5d\x1b\xee\x24\xce\x77\x16\xc7\xc8\x6b\x6e\xc1\x1b\x09\x6d\x3a\x70\xd5\xf1\x4f\x0b\xeb\x4c\x23\x05\x48\x43\x99\x4e\x36\x25\xb7\x32\x41\x5a\x3a\x7a\x48\xbc\xb7\xa4\x44\xdf\x50\xb2\x72\xe0\xca\x68\x09\xaa\x3c\x6b\x4c\x93\xbe\xc2\xd5\xf2\x86\xce\xb4\x4a\xa0\x34\x4a\x91\x90\xe8\xc8\xd5\xe0\xda\xb8\x5a\x36\xe0\x33\x1c\x2a\xd3\xf8\x02\x2c\xbf\x49\xd8\x9a\xaf\x3c\xcd\x92\x2e\x25\x5c\xcd\xdd\xc0\x79\x90\x51\x5e\xbc\xd5\xf4\xd1\xca\x4b\xa8\x26\xec\xfc\xb2\x4b\x8b\x6c\xf4\xca\xb3\xc2\x03\xf0\xab\x57\x5f\xda\x9a\x47\xec\xf5\x6f\x76\xca\xc2\x78\xb3\x9d\xcf\xd3\xc3\x0e\x87\x63\x81\x25\x03\xac\xf3\xe8\xfd\x01\xcb\xc5\x5d\x6a\x41\xfa\xba\x58\x61\x11\xa8\xfe\x39\x62\x80\x8f\x67\x6f\xfb\xbc\xc8\x43\x03\xc8\xb3\x7f\xd9\xef\x02\x3f\xf1\xe7\x74\xfc\x3f\x1a\xa4\x39\xc2\x09\x43\xa2\xff\x73\x78\x4f\x48\x60\xb3\x1d\x52\x09\x89\xf0\xdd\x23\x7b\xa1\x3e\xe3\x75\x9f\xee\x43\xd4\xcf\x9e\xe1\x21\xf6\xbd\x6c\xc4\xa2\x35\x1b\x97\xc3\x1b\x47\x15\x2f\xdd\x7c\x3f\x13\x9d\xcd\xf4\x87\x5d\x3d\x0b\x49\x88\x5d\x48\x4c\x0d\x12\xcc\x6b\x4f\x91\x61\xb1\x13\x70\xcd\xd8\xfc\xa2\xed\x4c\xa7\xd9\xd7\x00\x17\x9c\xd1\x70\x7a\x02\x00\x00")
+
+func dbMigrations4_lowercase_shasSqlBytes() ([]byte, error) {
+	return bindataRead(
+		_dbMigrations4_lowercase_shasSql,
+		"db/migrations/4_lowercase_shas.sql",
+	)
+}
+
+func dbMigrations4_lowercase_shasSql() (*asset, error) {
+	bytes, err := dbMigrations4_lowercase_shasSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "db/migrations/4_lowercase_shas.sql", size: 634, mode: os.FileMode(420), modTime: time.Unix(1791986838, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
+var _dbMigrations5_build_retriesSql = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x84\x8f\x41\x4b\xc3\x40\x10\x85\xef\xfb\x2b\xde\x51\xd1\x08\x9e\x73\x8a\x6e\x3c\xad\x89\x84\xe4\x5c\xd6\xee\xa4\x0e\x36\x9b\x65\x32\x8b\xf8\xef\x25\xb6\x82\x94\x42\x6e\x03\xdf\x9b\xef\xf1\x8a\x02\x77\x13\x1f\xc4\x2b\x61\x48\xa6\x28\xd0\x91\x0a\x53\xc0\x7b\xe6\x63\x58\xe0\x85\x70\xe4\xf8\x49\x01\x3a\x43\x3f\xe8\x04\xd6\xeb\x1b\x72\xca\xde\xc3\xc7\x80\xfd\x9c\xa3\x22\x27\x8c\x32\x4f\x2b\x5f\x6d\x23\xcb\xa2\xf0\xaa\x34\x25\x7d\x30\x95\xeb\xeb\x0e\x7d\xf5\xe4\xea\xbf\x82\xca\x5a\x3c\xb7\x6e\x78\x6d\x90\xbc\x50\xd4\xdd\x2f\xd8\x71\x40\xce\x1c\x20\x34\x92\x50\xdc\xd3\x72\xfe\xb8\xe1\x70\x5b\x6e\x98\xce\x85\xe0\xa8\x74\x20\x41\xd3\xf6\x68\x06\xe7\x60\xeb\x97\x6a\x70\x3d\x1e\x4b\x63\xfe\x6f\xb7\xf3\x57\xbc\xe6\xb4\x5d\xfb\x76\x21\x2d\xb7\x72\x17\x33\x4a\xf3\x33\x00\x22\xc4\x1a\x98\x65\x01\x00\x00")
+
+func dbMigrations5_build_retriesSqlBytes() ([]byte, error) {
+	return bindataRead(
+		_dbMigrations5_build_retriesSql,
+		"db/migrations/5_build_retries.sql",
+	)
+}
+
+func dbMigrations5_build_retriesSql() (*asset, error) {
+	bytes, err := dbMigrations5_build_retriesSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "db/migrations/5_build_retries.sql", size: 357, mode: os.FileMode(420), modTime: time.Unix(1791987138, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
+var _dbMigrations6_completed_after_startedSql = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x8c\xd0\xdf\x4a\xc3\x30\x18\x05\xf0\xfb\x3c\xc5\xb9\x54\xa4\x7b\x81\xaa\x50\xdb\xc0\xc4\xb1\x8d\x2e\xc3\xcb\x91\x25\xdf\x96\xd2\x3f\x29\xc9\x37\x8a\x6f\x2f\x05\xab\x2d\x78\xb1\xcb\xe4\x9c\xfc\x0e\x24\x49\xf0\xd4\x56\xd7\xa0\x99\x70\xec\x45\x92\x20\x6f\xbc\xa9\x11\x6b\x1a\x70\x26\x1e\x88\x3a\x0c\x3e\xd4\x14\x22\x9c\x8e\xe8\x83\xb7\x37\x43\x16\xe7\x5b\xd5\xd8\x08\x76\x9a\x61\x7c\xdb\x37\xc4\xe3\x2d\x5d\x7c\x20\xb0\xa3\xaf\x11\x8b\xac\x03\x93\x5d\x21\x6f\x74\xdb\x83\x9d\x8f\x34\x75\xb4\xb5\x55\x77\x1d\xab\x30\x8e\x4c\xbd\x12\xc7\x7d\x91\x29\x39\xc9\x07\xa9\xfe\xe0\x93\x66\xbc\x4c\xdc\x78\xf8\x5c\xcb\x52\x2e\xf3\xe7\x59\x9e\x8a\x6c\xa3\x64\x09\x95\xbd\x6d\x7e\xc5\xac\x28\x90\xef\xb6\x07\x55\x66\xef\xdb\x05\x7e\x61\x0a\xa7\x9f\xd7\xc8\xd7\x32\xff\xc0\xc3\xc2\x7e\x9d\x8f\x3f\xa6\x42\xcc\x3f\xae\xf0\x43\xf7\xdf\x5e\x51\xee\xf6\x77\x0c\xa6\xe2\x7b\x00\x6f\xed\xf7\x07\x86\x01\x00\x00")
+
+func dbMigrations6_completed_after_startedSqlBytes() ([]byte, error) {
+	return bindataRead(
+		_dbMigrations6_completed_after_startedSql,
+		"db/migrations/6_completed_after_started.sql",
+	)
+}
+
+func dbMigrations6_completed_after_startedSql() (*asset, error) {
+	bytes, err := dbMigrations6_completed_after_startedSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "db/migrations/6_completed_after_started.sql", size: 390, mode: os.FileMode(420), modTime: time.Unix(1791987209, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
+var _dbMigrations7_build_artifactsSql = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\x6c\x92\x31\x6f\xdb\x30\x10\x85\x77\xfe\x8a\xb7\x45\x42\xed\x4e\xdd\x32\xb9\xb5\x52\x18\x10\xe4\xc2\xb1\x81\x6e\x04\x25\x9e\xe5\x43\x24\x52\x25\x8f\x55\x94\x5f\x5f\xa8\x4a\x82\x36\xf6\xc8\xef\x1e\x3e\x12\x8f\xb7\x5e\xe3\x53\xcf\x6d\x30\x42\x38\x0d\x6a\xbd\xc6\x03\x77\x14\x21\x17\x23\x30\xa8\x13\x77\x16\x43\xf0\x36\x35\x64\x57\xe8\xf8\x89\x50\xb3\x33\x81\x29\xc2\x07\x74\xbe\x8d\xab\x25\xdd\x18\x87\x9a\x60\xfd\xe8\x3a\x6f\x2c\xd9\xd9\x76\x0e\xbe\x87\x5c\x68\x31\x7d\x56\xdf\x0e\xc5\xe6\x58\xe0\xb8\xf9\x5a\x16\x0b\xd3\x26\x08\x9f\x4d\x23\x11\x99\x02\xd8\x22\x25\xb6\xa8\xf6\x47\x54\xa7\xb2\xc4\xb6\x78\xd8\x9c\xca\xe3\x5f\xaa\x5b\x72\x34\xbf\x55\xff\xfe\x92\xe5\x18\x02\xf7\x26\x4c\x78\xa2\x69\xa5\x80\x48\xbf\xf0\x58\x1c\x76\x9b\x72\x3e\x2d\xf2\x2b\x5d\xa0\x33\x05\x72\x0d\xc5\xe5\xfa\x98\xb1\xcd\xe7\xbc\x33\x3d\x41\xe8\x59\xde\xb3\x33\x4d\xa1\xbb\x86\x91\x5f\x48\xd7\x93\xcc\x0e\x6e\xd9\xfd\x3f\x6d\xbc\x13\x72\xa2\x65\x1a\x6e\x08\x9b\x40\x46\xc8\x6a\x23\x10\xee\x29\x8a\xe9\x07\x8c\x2c\x17\x9f\x16\x82\x17\xef\x08\x96\xce\x26\x75\x82\xcc\xf9\x31\xcb\xf1\x9a\x5e\x66\x77\x49\x9a\xbb\xfc\xdd\xaa\xf2\x7b\xf5\xd6\xeb\xae\xda\x16\x3f\xc1\xce\xd2\xb3\xfe\xd0\xae\xf6\xee\x15\xb1\xc5\xbe\xba\x2a\xff\xf4\xb8\xab\xbe\xa3\x96\x40\x84\xec\x2d\x38\xab\xff\x5d\x91\xad\x1f\x9d\xda\x1e\xf6\x3f\x6e\xff\xe0\xbd\xfa\x33\x00\x9a\x46\x56\x33\x50\x02\x00\x00")
+
+func dbMigrations7_build_artifactsSqlBytes() ([]byte, error) {
+	return bindataRead(
+		_dbMigrations7_build_artifactsSql,
+		"db/migrations/7_build_artifacts.sql",
+	)
+}
+
+func dbMigrations7_build_artifactsSql() (*asset, error) {
+	bytes, err := dbMigrations7_build_artifactsSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "db/migrations/7_build_artifacts.sql", size: 592, mode: os.FileMode(420), modTime: time.Unix(1791987260, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
+var _dbMigrations8_normalize_branchesSql = []byte("\x1f\x8b\x08\x00\x00\x09\x6e\x88\x00\xff\xa4\x91\xcd\x4a\xc3\x50\x10\x85\xf7\x79\x8a\x43\x40\xd2\x50\x63\x71\xed\x0f\x28\x0d\x28\xba\x10\x6d\x71\x3d\x69\x26\xb9\x17\x9a\x7b\xcb\xcc\x84\xf8\xf8\x92\xfe\x48\xba\xd1\x85\xcb\xe1\x1c\xbe\xef\xc0\x14\x05\xe6\x9d\x6f\x85\x8c\xb1\xde\x25\x45\x81\x47\xa1\xb0\x71\xac\x20\x61\x84\x38\x40\x2d\x0a\xd7\x18\xbc\xb9\xd8\x1b\xcc\xb1\x17\x08\x37\xd8\x09\x37\xfe\xeb\x12\x1a\x61\x8e\x0c\x55\xef\xb7\xb5\x62\x23\x4c\xc6\xf5\xc8\x6a\x24\x76\x48\x85\x1b\x5d\x38\xa6\x5a\x17\x1d\xa9\xb1\xa4\xa0\x50\x23\xfd\x39\x84\x11\xc3\x08\x86\x52\xc7\xa8\xf6\x0b\xae\x92\xf5\xdb\xf2\x61\x55\x9e\xb0\x1f\xe5\xea\x98\xe0\x0e\x95\x89\xef\x66\x87\x33\xc7\xe7\x53\xf9\x5e\x9e\xc2\xdb\xfb\xf3\xf4\xe6\x37\x8e\xf6\x95\x9a\xf8\xd0\x1e\xdb\x87\xc5\x5b\x0e\xad\xb9\x59\x36\x19\x9e\xe5\x98\xe3\x3a\x4f\xce\x54\xaf\xcf\x2f\x25\xa6\xad\x8b\xec\xbf\x36\xa3\xf6\x6f\xd9\xbe\x34\xba\x92\xe9\xfb\x96\x71\x08\xc9\xf7\x00\x9d\xcb\x42\xcc\xd0\x01\x00\x00")
+
+func dbMigrations8_normalize_branchesSqlBytes() ([]byte, error) {
+	return bindataRead(
+		_dbMigrations8_normalize_branchesSql,
+		"db/migrations/8_normalize_branches.sql",
+	)
+}
+
+func dbMigrations8_normalize_branchesSql() (*asset, error) {
+	bytes, err := dbMigrations8_normalize_branchesSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "db/migrations/8_normalize_branches.sql", size: 464, mode: os.FileMode(420), modTime: time.Unix(1791988198, 0)}
+	a := &asset{bytes: bytes, info: info}
+	return a, nil
+}
+
 // Asset loads and returns the asset for the given name.
 // It returns an error if the asset could not be found or
 // could not be loaded.
@@ -141,6 +288,13 @@ func AssetNames() []string {
 // _bindata is a table, holding each asset generator, mapped to its name.
 var _bindata = map[string]func() (*asset, error){
 	"db/migrations/1_initial_schema.sql": dbMigrations1_initial_schemaSql,
+	"db/migrations/2_build_failures.sql": dbMigrations2_build_failuresSql,
+	"db/migrations/3_idempotency_key.sql": dbMigrations3_idempotency_keySql,
+	"db/migrations/4_lowercase_shas.sql": dbMigrations4_lowercase_shasSql,
+	"db/migrations/5_build_retries.sql": dbMigrations5_build_retriesSql,
+	"db/migrations/6_completed_after_started.sql": dbMigrations6_completed_after_startedSql,
+	"db/migrations/7_build_artifacts.sql": dbMigrations7_build_artifactsSql,
+	"db/migrations/8_normalize_branches.sql": dbMigrations8_normalize_branchesSql,
 }
 
 // AssetDir returns the file names below a certain
@@ -186,6 +340,13 @@ var _bintree = &bintree{nil, map[string]*bintree{
 	"db": &bintree{nil, map[string]*bintree{
 		"migrations": &bintree{nil, map[string]*bintree{
 			"1_initial_schema.sql": &bintree{dbMigrations1_initial_schemaSql, map[string]*bintree{}},
+			"2_build_failures.sql": &bintree{dbMigrations2_build_failuresSql, map[string]*bintree{}},
+			"3_idempotency_key.sql": &bintree{dbMigrations3_idempotency_keySql, map[string]*bintree{}},
+			"4_lowercase_shas.sql": &bintree{dbMigrations4_lowercase_shasSql, map[string]*bintree{}},
+			"5_build_retries.sql": &bintree{dbMigrations5_build_retriesSql, map[string]*bintree{}},
+			"6_completed_after_started.sql": &bintree{dbMigrations6_completed_after_startedSql, map[string]*bintree{}},
+			"7_build_artifacts.sql": &bintree{dbMigrations7_build_artifactsSql, map[string]*bintree{}},
+			"8_normalize_branches.sql": &bintree{dbMigrations8_normalize_branchesSql, map[string]*bintree{}},
 		}},
 	}},
 }}
@@ -1,14 +1,17 @@
 package conveyor
 
 import (
+	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
+	"code.google.com/p/go-uuid/uuid"
 	"github.com/jmoiron/sqlx"
-	"github.com/lib/pq"
 )
 
 // ErrDuplicateBuild can be returned when we try to start a build for a sha that
@@ -16,31 +19,139 @@ import (
 // have 1 concurrent build for a given sha.
 //
 // This is also enforced at the db level with the `unique_build` constraint.
+//
+// Duplicates are usually returned as a *DuplicateBuildError, which identifies
+// the conflicting build, so use IsDuplicateBuild rather than comparing errors
+// with ErrDuplicateBuild.
 var ErrDuplicateBuild = errors.New("a build for this sha is already pending or building")
 
-// The database constraint that counts as an ErrDuplicateBuild.
+// ErrDuplicateID is returned by buildsCreate when the build's id is already
+// used by another build.
+var ErrDuplicateID = errors.New("a build with this id already exists")
+
+// ErrInvalidTransition is returned when a build can't be moved to the requested
+// state from its current state.
+var ErrInvalidTransition = errors.New("invalid build state transition")
+
+// The unique index that prevents duplicate active builds for a sha.
 const uniqueBuildConstraint = "unique_build"
 
-// Build represents a build of a commit.
+// DuplicateBuildError is returned by buildsCreate when the sha already has a
+// pending or building build. It has the same message as ErrDuplicateBuild,
+// which is returned instead when the conflicting build can't be found.
+type DuplicateBuildError struct {
+	// The id of the build that's already pending or building.
+	ExistingBuildID string
+}
+
+func (e *DuplicateBuildError) Error() string {
+	return ErrDuplicateBuild.Error()
+}
+
+// Unwrap returns ErrDuplicateBuild.
+func (e *DuplicateBuildError) Unwrap() error {
+	return ErrDuplicateBuild
+}
+
+// IsDuplicateBuild returns true if err is ErrDuplicateBuild or a
+// *DuplicateBuildError.
+func IsDuplicateBuild(err error) bool {
+	if _, ok := err.(*DuplicateBuildError); ok {
+		return true
+	}
+	return err == ErrDuplicateBuild
+}
+
+// Build represents a build of a commit. The json tags mirror the column names
+// so that API consumers get stable field names. Timestamps that haven't been
+// set yet are serialized as null. Timestamps are stored without a time zone, as
+// UTC, like the created_at default, so they're written with time.Now().UTC().
 type Build struct {
 	// A unique identifier for this build.
-	ID string `db:"id"`
+	ID string `db:"id" json:"id"`
 	// Autogenerated sequence id.
-	Seq int64 `db:"seq"`
+	Seq int64 `db:"seq" json:"seq"`
 	// The repository that this build relates to.
-	Repository string `db:"repository"`
+	Repository string `db:"repository" json:"repository"`
 	// The branch that this build relates to.
-	Branch string `db:"branch"`
+	Branch string `db:"branch" json:"branch"`
 	// The sha that this build relates to.
-	Sha string `db:"sha"`
+	Sha string `db:"sha" json:"sha"`
 	// The current state of the build.
-	State BuildState `db:"state"`
+	State BuildState `db:"state" json:"state"`
 	// The time that this build was created.
-	CreatedAt time.Time `db:"created_at"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
 	// The time that the build was started.
-	StartedAt *time.Time `db:"started_at"`
+	StartedAt *time.Time `db:"started_at" json:"started_at"`
 	// The time that the build was completed.
-	CompletedAt *time.Time `db:"completed_at"`
+	CompletedAt *time.Time `db:"completed_at" json:"completed_at"`
+	// The reason that the build failed, if it failed.
+	FailureReason FailureReason `db:"failure_reason" json:"failure_reason"`
+	// The error message if the build failed.
+	Error *string `db:"error" json:"error"`
+	// An optional client provided key that identifies the request that
+	// created this build.
+	IdempotencyKey *string `db:"idempotency_key" json:"idempotency_key"`
+	// If this build is a retry, the build that it retried.
+	ParentBuildID *string `db:"parent_build_id" json:"parent_build_id"`
+	// The attempt number for the sha, starting at 1. Retries increment this.
+	Attempt int `db:"attempt" json:"attempt"`
+}
+
+// HasStarted returns true if the build has moved to the building state.
+func (b *Build) HasStarted() bool {
+	return b.StartedAt != nil
+}
+
+// HasCompleted returns true if the build has succeeded or failed.
+func (b *Build) HasCompleted() bool {
+	return b.CompletedAt != nil
+}
+
+// StartedAtOrZero returns the time that the build was started, or the zero
+// time if it hasn't started.
+func (b *Build) StartedAtOrZero() time.Time {
+	if !b.HasStarted() {
+		return time.Time{}
+	}
+	return *b.StartedAt
+}
+
+// CompletedAtOrZero returns the time that the build was completed, or the zero
+// time if it hasn't completed.
+func (b *Build) CompletedAtOrZero() time.Time {
+	if !b.HasCompleted() {
+		return time.Time{}
+	}
+	return *b.CompletedAt
+}
+
+// Duration returns how long the build took to run. It returns false if the
+// build hasn't started or hasn't completed.
+func (b *Build) Duration() (time.Duration, bool) {
+	if !b.HasStarted() || !b.HasCompleted() {
+		return 0, false
+	}
+	return b.CompletedAt.Sub(*b.StartedAt), true
+}
+
+// FormatBuildDuration formats a build duration compactly, like "2m13s", or
+// "1h04m" for builds that took over an hour. It takes the result of
+// Build.Duration, and returns "running" if the build hasn't completed.
+func FormatBuildDuration(d time.Duration, ok bool) string {
+	if !ok {
+		return "running"
+	}
+
+	d = (d + time.Second/2) / time.Second * time.Second
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%02dm", d/time.Hour, d%time.Hour/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%02ds", d/time.Minute, d%time.Minute/time.Second)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
 }
 
 type BuildState int
@@ -70,18 +181,7 @@ func (s BuildState) String() string {
 // Scan implements the sql.Scanner interface.
 func (s *BuildState) Scan(src interface{}) error {
 	if v, ok := src.([]byte); ok {
-		switch string(v) {
-		case "pending":
-			*s = StatePending
-		case "building":
-			*s = StateBuilding
-		case "failed":
-			*s = StateFailed
-		case "succeeded":
-			*s = StateSucceeded
-		default:
-			return fmt.Errorf("unknown build state: %v", string(v))
-		}
+		return s.parse(string(v))
 	}
 
 	return nil
@@ -92,18 +192,223 @@ func (s BuildState) Value() (driver.Value, error) {
 	return driver.Value(s.String()), nil
 }
 
-// buildsCreate inserts a new build into the database.
-func buildsCreate(tx *sqlx.Tx, b *Build) error {
-	const createBuildSql = `INSERT INTO builds (repository, branch, sha, state) VALUES (:repository, :branch, :sha, :state) RETURNING id`
-	err := insert(tx, createBuildSql, b, &b.ID)
-	if err, ok := err.(*pq.Error); ok {
-		if err.Constraint == uniqueBuildConstraint {
-			return ErrDuplicateBuild
+// MarshalJSON implements the json.Marshaler interface. The state is encoded as
+// its string representation.
+func (s BuildState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (s *BuildState) UnmarshalJSON(data []byte) error {
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	return s.parse(v)
+}
+
+func (s *BuildState) parse(v string) error {
+	switch v {
+	case "pending":
+		*s = StatePending
+	case "building":
+		*s = StateBuilding
+	case "failed":
+		*s = StateFailed
+	case "succeeded":
+		*s = StateSucceeded
+	default:
+		return fmt.Errorf("unknown build state: %v", v)
+	}
+
+	return nil
+}
+
+// FailureReason classifies why a build failed, so that failures can be
+// aggregated without parsing error messages.
+type FailureReason string
+
+const (
+	FailureReasonInfra        FailureReason = "infra"
+	FailureReasonTestFailure  FailureReason = "test_failure"
+	FailureReasonCompileError FailureReason = "compile_error"
+	FailureReasonTimeout      FailureReason = "timeout"
+	FailureReasonCancelled    FailureReason = "cancelled"
+
+	// FailureReasonUnknown is used when a failed build has no reason.
+	FailureReasonUnknown FailureReason = "unknown"
+)
+
+// Scan implements the sql.Scanner interface.
+func (r *FailureReason) Scan(src interface{}) error {
+	if src == nil {
+		*r = ""
+		return nil
+	}
+
+	if v, ok := src.([]byte); ok {
+		switch reason := FailureReason(v); reason {
+		case FailureReasonInfra, FailureReasonTestFailure, FailureReasonCompileError, FailureReasonTimeout, FailureReasonCancelled, FailureReasonUnknown:
+			*r = reason
+		default:
+			return fmt.Errorf("unknown failure reason: %v", string(v))
+		}
+	}
+
+	return nil
+}
+
+// Value implements the driver.Value interface. An empty reason is stored as
+// NULL.
+func (r FailureReason) Value() (driver.Value, error) {
+	if r == "" {
+		return nil, nil
+	}
+	return driver.Value(string(r)), nil
+}
+
+// ErrInvalidBranch is returned by buildsCreate when the branch is set, but is
+// only whitespace or a bare ref prefix.
+var ErrInvalidBranch = errors.New("branch must not be blank")
+
+// branchRefPrefixes are the git ref prefixes that are stripped from branch
+// names, since some webhooks send the full ref and others the bare name.
+var branchRefPrefixes = []string{"refs/heads/", "refs/tags/"}
+
+// normalizeBranch strips surrounding whitespace and any ref prefix from
+// branch, returning ErrInvalidBranch if nothing is left. An empty branch is
+// left alone, since builds can be requested for just a sha.
+func normalizeBranch(branch string) (string, error) {
+	if branch == "" {
+		return "", nil
+	}
+	branch = strings.TrimSpace(branch)
+	for _, prefix := range branchRefPrefixes {
+		if strings.HasPrefix(branch, prefix) {
+			branch = strings.TrimPrefix(branch, prefix)
+			break
 		}
 	}
+	if strings.TrimSpace(branch) == "" {
+		return "", ErrInvalidBranch
+	}
+	return branch, nil
+}
+
+// buildsCreate inserts a new build into the database. Hex shas are normalized
+// to lowercase, and the branch has any ref prefix stripped. If b.ID is set,
+// it's used as the id of the build, and ErrDuplicateID is returned if it's
+// already taken. If the build has an idempotency key that was already used, b
+// is populated with the existing build instead.
+func buildsCreate(tx *sqlx.Tx, b *Build) error {
+	_, err := buildsCreateIdempotent(tx, b)
 	return err
 }
 
+// buildsCreateIdempotent is like buildsCreate, but also returns whether a new
+// build was inserted. It returns false when the idempotency key matched an
+// existing build.
+//
+// If the sha already has an active build, a *DuplicateBuildError is returned.
+func buildsCreateIdempotent(tx *sqlx.Tx, b *Build) (bool, error) {
+	branch, err := normalizeBranch(b.Branch)
+	if err != nil {
+		return false, err
+	}
+	b.Branch = branch
+	b.Sha = normalizeSha(b.Sha)
+	if b.Attempt == 0 {
+		b.Attempt = 1
+	}
+
+	// Conflicts are ignored rather than raised, so that the transaction isn't
+	// aborted and we can look up the conflicting build below.
+	// If the build doesn't already have an id, the database generates one.
+	const createBuildSql = `INSERT INTO builds (id, repository, branch, sha, state, started_at, idempotency_key, parent_build_id, attempt) VALUES (COALESCE(CAST(NULLIF(:id, '') AS uuid), uuid_generate_v4()), :repository, :branch, :sha, :state, :started_at, :idempotency_key, :parent_build_id, :attempt)
+ON CONFLICT DO NOTHING
+RETURNING id`
+	rows, err := tx.NamedQuery(createBuildSql, b)
+	if err != nil {
+		return false, err
+	}
+
+	inserted := rows.Next()
+	if inserted {
+		err = rows.Scan(&b.ID)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if inserted {
+		return true, nil
+	}
+
+	// The id is already taken, like when an IDGenerator produced a
+	// collision. That isn't a duplicate build, unless it's the build that
+	// the idempotency key was already used for.
+	if b.ID != "" {
+		existing, err := buildsFindByID(tx, b.ID)
+		if err == nil {
+			if b.IdempotencyKey == nil || existing.IdempotencyKey == nil || *b.IdempotencyKey != *existing.IdempotencyKey {
+				return false, ErrDuplicateID
+			}
+			*b = *existing
+			return false, nil
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+
+	// The idempotency key has already been used, so return the build it
+	// created.
+	if b.IdempotencyKey != nil {
+		existing, err := buildsFindByIdempotencyKey(tx, *b.IdempotencyKey)
+		if err == nil {
+			*b = *existing
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+
+	// Otherwise the insert conflicted with the active build for the sha.
+	const findActiveSql = `SELECT id FROM builds WHERE sha = ? AND state IN ('pending', 'building') LIMIT 1`
+	var existingID string
+	if err := tx.Get(&existingID, tx.Rebind(findActiveSql), b.Sha); err != nil {
+		if err == sql.ErrNoRows {
+			// The conflicting build completed before we could
+			// find it.
+			return false, ErrDuplicateBuild
+		}
+		return false, err
+	}
+
+	return false, &DuplicateBuildError{ExistingBuildID: existingID}
+}
+
+// buildsCreateAndStart inserts a new build that's already building, for when
+// the caller is going to run the build itself rather than queueing it. Like
+// buildsCreate, a *DuplicateBuildError is returned if the sha already has an
+// active build.
+func buildsCreateAndStart(tx *sqlx.Tx, b *Build) (*Build, error) {
+	now := time.Now().UTC()
+	b.State = StateBuilding
+	b.StartedAt = &now
+
+	if err := buildsCreate(tx, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
 // buildsFindByID finds a build by ID.
 func buildsFindByID(tx *sqlx.Tx, buildID string) (*Build, error) {
 	const findBuildSql = `SELECT * FROM builds WHERE id = ? LIMIT 1`
@@ -112,6 +417,45 @@ func buildsFindByID(tx *sqlx.Tx, buildID string) (*Build, error) {
 	return &b, err
 }
 
+// buildsFindByIDs finds the builds with the given ids, keyed by their
+// lowercase id. Ids that don't match a build, including ones that aren't valid
+// uuids, are returned as missing, in the order that they were given.
+func buildsFindByIDs(tx *sqlx.Tx, buildIDs []string) (map[string]*Build, []string, error) {
+	found := make(map[string]*Build)
+
+	var valid []string
+	for _, id := range buildIDs {
+		if uuid.Parse(id) != nil {
+			valid = append(valid, id)
+		}
+	}
+
+	if len(valid) > 0 {
+		sql, args, err := sqlx.In(`SELECT * FROM builds WHERE id IN (?)`, valid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var builds []*Build
+		if err := tx.Select(&builds, tx.Rebind(sql), args...); err != nil {
+			return nil, nil, err
+		}
+
+		for _, b := range builds {
+			found[b.ID] = b
+		}
+	}
+
+	var missing []string
+	for _, id := range buildIDs {
+		if _, ok := found[strings.ToLower(id)]; !ok {
+			missing = append(missing, id)
+		}
+	}
+
+	return found, missing, nil
+}
+
 // buildsFindByRepoSha finds a build by repository and sha.
 func buildsFindByRepoSha(tx *sqlx.Tx, repoSha string) (*Build, error) {
 	parts := strings.Split(repoSha, "@")
@@ -121,22 +465,1122 @@ AND sha = ?
 ORDER BY seq desc
 LIMIT 1`
 	var b Build
-	err := tx.Get(&b, tx.Rebind(sql), parts[0], parts[1])
+	err := tx.Get(&b, tx.Rebind(sql), parts[0], normalizeSha(parts[1]))
+	return &b, err
+}
+
+// The length of a full git sha.
+const fullShaLength = 40
+
+// ErrInvalidSha is returned when a build is requested for a sha that isn't
+// hexadecimal.
+var ErrInvalidSha = errors.New("sha must only contain hexadecimal characters")
+
+// validateSha returns ErrInvalidSha if sha contains non-hex characters.
+func validateSha(sha string) error {
+	for _, r := range sha {
+		switch {
+		case '0' <= r && r <= '9', 'a' <= r && r <= 'f', 'A' <= r && r <= 'F':
+		default:
+			return ErrInvalidSha
+		}
+	}
+	return nil
+}
+
+// normalizeSha lowercases sha if it's hexadecimal, since git shas are case
+// insensitive. Anything else, like a synthetic revision id accepted by a custom
+// ShaValidator, may be case sensitive and is returned as is.
+func normalizeSha(sha string) string {
+	if validateSha(sha) != nil {
+		return sha
+	}
+	return strings.ToLower(sha)
+}
+
+// buildsFindByRepoShaPrefix is like buildsFindByRepoSha, but when the sha is
+// abbreviated, it matches the most recent build whose sha starts with it.
+func buildsFindByRepoShaPrefix(tx *sqlx.Tx, repoSha string) (*Build, error) {
+	parts := strings.Split(repoSha, "@")
+	if len(parts[1]) >= fullShaLength {
+		return buildsFindByRepoSha(tx, repoSha)
+	}
+
+	var sql = `SELECT * FROM builds
+WHERE repository = ?
+AND sha LIKE ?
+ORDER BY seq desc
+LIMIT 1`
+	var b Build
+	err := tx.Get(&b, tx.Rebind(sql), parts[0], escapeLike(normalizeSha(parts[1]))+"%")
+	return &b, err
+}
+
+// minShaPrefixLength is the shortest sha prefix that buildsResolveSha accepts.
+const minShaPrefixLength = 4
+
+var (
+	// ErrBuildNotFound is returned when there's no build matching a lookup.
+	// It's sql.ErrNoRows, so it's handled like any other missing record.
+	ErrBuildNotFound = sql.ErrNoRows
+
+	// ErrAmbiguousSha is returned when a sha prefix matches builds for more
+	// than one sha.
+	ErrAmbiguousSha = errors.New("sha prefix matches more than one commit")
+
+	// ErrShaPrefixTooShort is returned when a sha prefix is too short to
+	// resolve.
+	ErrShaPrefixTooShort = fmt.Errorf("sha prefix must be at least %d characters", minShaPrefixLength)
+)
+
+// buildsResolveSha finds the most recent build of the commit whose sha starts
+// with shaPrefix. Unlike buildsFindByRepoShaPrefix, ErrAmbiguousSha is returned
+// if builds for more than one sha match, rather than picking the latest.
+func buildsResolveSha(tx *sqlx.Tx, repository, shaPrefix string) (*Build, error) {
+	if len(shaPrefix) < minShaPrefixLength {
+		return nil, ErrShaPrefixTooShort
+	}
+
+	if err := validateSha(shaPrefix); err != nil {
+		return nil, err
+	}
+
+	const sql = `SELECT DISTINCT sha FROM builds
+WHERE repository = ?
+AND sha LIKE ?
+LIMIT 2`
+	var shas []string
+	if err := tx.Select(&shas, tx.Rebind(sql), repository, normalizeSha(shaPrefix)+"%"); err != nil {
+		return nil, err
+	}
+
+	switch len(shas) {
+	case 0:
+		return nil, ErrBuildNotFound
+	case 1:
+		return buildsFindByRepoSha(tx, repository+"@"+shas[0])
+	default:
+		return nil, ErrAmbiguousSha
+	}
+}
+
+// buildsHasActive returns true if the sha has a pending or building build for
+// the repository and branch. This is cheaper than finding the build when only
+// a yes or no is needed. If branch is empty, builds on any branch of the
+// repository count. This is narrower than the unique_build index, which covers
+// the sha across all repositories, so buildsCreate can still conflict when this
+// returns false.
+func buildsHasActive(tx *sqlx.Tx, repository, branch, sha string) (bool, error) {
+	branch, err := normalizeBranch(branch)
+	if err != nil {
+		return false, err
+	}
+
+	const sql = `SELECT EXISTS(
+	SELECT 1 FROM builds
+	WHERE sha = ?
+	AND state IN ('pending', 'building')
+	AND repository = ?
+	AND (? = '' OR branch = ?)
+)`
+	var exists bool
+	err = tx.Get(&exists, tx.Rebind(sql), normalizeSha(sha), repository, branch, branch)
+	return exists, err
+}
+
+// buildsActiveShaPrefixMatch returns the id of a pending or building build in
+// the repository whose sha is a prefix of sha, or that sha is a prefix of. An
+// empty id is returned if there isn't one.
+func buildsActiveShaPrefixMatch(tx *sqlx.Tx, repository, sha string) (string, error) {
+	const matchSql = `SELECT id FROM builds
+WHERE repository = ?
+AND state IN ('pending', 'building')
+AND (sha LIKE ? OR ? LIKE sha || '%')
+LIMIT 1`
+	sha = normalizeSha(sha)
+	var id string
+	err := tx.Get(&id, tx.Rebind(matchSql), repository, escapeLike(sha)+"%", sha)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return id, err
+}
+
+// buildsLockRepository takes a transaction level advisory lock on the
+// repository, serializing callers until the transaction ends.
+func buildsLockRepository(tx *sqlx.Tx, repository string) error {
+	const sql = `SELECT pg_advisory_xact_lock(hashtext(?))`
+	_, err := tx.Exec(tx.Rebind(sql), repository)
+	return err
+}
+
+// buildsFindByIdempotencyKey finds the build that was created with the given
+// idempotency key.
+func buildsFindByIdempotencyKey(tx *sqlx.Tx, key string) (*Build, error) {
+	const sql = `SELECT * FROM builds WHERE idempotency_key = ? LIMIT 1`
+	var b Build
+	err := tx.Get(&b, tx.Rebind(sql), key)
 	return &b, err
 }
 
 // buildsUpdateState changes the state of a build.
 func buildsUpdateState(tx *sqlx.Tx, buildID string, state BuildState) error {
-	var sql string
 	switch state {
 	case StateBuilding:
-		sql = `UPDATE builds SET state = ?, started_at = ? WHERE id = ?`
+		const sql = `UPDATE builds SET state = ?, started_at = ? WHERE id = ?`
+		_, err := tx.Exec(tx.Rebind(sql), state, time.Now().UTC(), buildID)
+		return err
+	case StateSucceeded, StateFailed:
+		return buildsComplete(tx, buildID, `state = ?`, state)
+	default:
+		panic(fmt.Sprintf("not implemented for %s", state))
+	}
+}
+
+// canTransition returns true if a build can be moved from one state to
+// another. Builds only move forward, and completed builds never change.
+func canTransition(from, to BuildState) bool {
+	switch from {
+	case StatePending:
+		return to != StatePending
+	case StateBuilding:
+		return to == StateFailed || to == StateSucceeded
+	default:
+		return false
+	}
+}
+
+// buildsReconcile moves a build to the state reported by an external system,
+// if that's a valid transition from its current state. Discrepancies that
+// can't be reconciled are logged.
+func buildsReconcile(tx *sqlx.Tx, buildID string, state BuildState) error {
+	const sql = `SELECT state FROM builds WHERE id = ? FOR UPDATE`
+	var current BuildState
+	if err := tx.Get(&current, tx.Rebind(sql), buildID); err != nil {
+		return err
+	}
+
+	if current == state {
+		return nil
+	}
+
+	if !canTransition(current, state) {
+		log.Printf("build %s is %s, but was reported as %s, not reconciling\n", buildID, current, state)
+		return nil
+	}
+
+	log.Printf("build %s is %s, but was reported as %s, reconciling\n", buildID, current, state)
+	return buildsUpdateState(tx, buildID, state)
+}
+
+// buildsUpdateStateReturning is like buildsUpdateState, but returns the updated
+// build, saving a query to read it back. Unlike buildsUpdateState, the
+// transition is validated, and ErrInvalidTransition is returned if the build
+// can't move to the state.
+func buildsUpdateStateReturning(tx *sqlx.Tx, buildID string, state BuildState) (*Build, error) {
+	var (
+		b   *Build
+		err error
+	)
+	switch state {
+	case StateBuilding:
+		const startSql = `UPDATE builds SET state = ?, started_at = ? WHERE id = ? AND state = 'pending' RETURNING *`
+		b = new(Build)
+		err = tx.Get(b, tx.Rebind(startSql), state, time.Now().UTC(), buildID)
 	case StateSucceeded, StateFailed:
-		sql = `UPDATE builds SET state = ?, completed_at = ? WHERE id = ?`
+		b, err = buildsCompleteReturning(tx, buildID, `state = ?`, state)
 	default:
 		panic(fmt.Sprintf("not implemented for %s", state))
 	}
 
-	_, err := tx.Exec(tx.Rebind(sql), state, time.Now(), buildID)
+	if err == sql.ErrNoRows {
+		// Either the build doesn't exist, or it's not in a state that
+		// can move to the new state.
+		if _, err := buildsFindByID(tx, buildID); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidTransition
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// buildsComplete sets completed_at on a build, along with the other columns in
+// set. Workers' clocks can be skewed from each other, so if the build appears
+// to have started after now, completed_at is clamped to started_at and a
+// warning is logged, rather than violating the completed_after_started check.
+//
+// Builds that have already completed, like ones that were cancelled while they
+// were building, are left alone.
+func buildsComplete(tx *sqlx.Tx, buildID string, set string, args ...interface{}) error {
+	_, err := buildsCompleteReturning(tx, buildID, set, args...)
+	if err == sql.ErrNoRows {
+		return nil
+	}
 	return err
 }
+
+// buildsCompleteReturning is like buildsComplete, but returns the completed
+// build. sql.ErrNoRows is returned if the build doesn't exist or has already
+// completed.
+func buildsCompleteReturning(tx *sqlx.Tx, buildID string, set string, args ...interface{}) (*Build, error) {
+	now := time.Now().UTC()
+
+	updateSql := `UPDATE builds SET ` + set + `, completed_at = GREATEST(?, started_at) WHERE id = ? AND state IN ('pending', 'building') RETURNING *`
+	var b Build
+	if err := tx.Get(&b, tx.Rebind(updateSql), append(args, now, buildID)...); err != nil {
+		return nil, err
+	}
+
+	if b.HasStarted() && b.StartedAt.After(now) {
+		log.Printf("build %s completed at %v, before it started at %v, clamping completed_at\n", buildID, now, *b.StartedAt)
+	}
+
+	return &b, nil
+}
+
+// buildsStart moves a pending build to the building state. The row is locked
+// so that concurrent callers are serialized, and only the caller that performed
+// the transition gets true. If the build is already building, false is
+// returned.
+func buildsStart(tx *sqlx.Tx, buildID string) (bool, error) {
+	const sql = `SELECT state FROM builds WHERE id = ? FOR UPDATE`
+	var state BuildState
+	if err := tx.Get(&state, tx.Rebind(sql), buildID); err != nil {
+		return false, err
+	}
+
+	switch state {
+	case StatePending:
+	case StateBuilding:
+		return false, nil
+	default:
+		return false, ErrInvalidTransition
+	}
+
+	return true, buildsUpdateState(tx, buildID, StateBuilding)
+}
+
+// buildsImport inserts a build that was run outside of conveyor, like when
+// migrating historical builds from another CI system. Unlike buildsCreate, the
+// caller provides the final state and all of the timestamps. This should only
+// be used for migrations.
+func buildsImport(tx *sqlx.Tx, b *Build) error {
+	switch b.State {
+	case StateSucceeded, StateFailed:
+	default:
+		return fmt.Errorf("cannot import a build in the %s state", b.State)
+	}
+
+	if b.CreatedAt.IsZero() {
+		return errors.New("cannot import a build without a created_at")
+	}
+
+	if !b.HasCompleted() {
+		return fmt.Errorf("cannot import a %s build without a completed_at", b.State)
+	}
+
+	if b.HasStarted() && b.CompletedAt.Before(*b.StartedAt) {
+		return errors.New("cannot import a build that completed before it started")
+	}
+
+	b.Sha = normalizeSha(b.Sha)
+
+	const importBuildSql = `INSERT INTO builds (repository, branch, sha, state, created_at, started_at, completed_at) VALUES (:repository, :branch, :sha, :state, :created_at, :started_at, :completed_at) RETURNING id, seq, attempt`
+	return insert(tx, importBuildSql, b, &b.ID, &b.Seq, &b.Attempt)
+}
+
+// buildsRetry creates a new pending build for the same repository, branch and
+// sha as a failed build, linked to it as its parent. Only failed builds can be
+// retried; ErrInvalidTransition is returned for anything else. If the sha
+// already has an active build, a *DuplicateBuildError is returned. Workers only
+// run builds that are pushed onto the BuildQueue, so it's up to the caller to
+// push the new build once the transaction commits, like Conveyor.RetryBuild
+// does.
+func buildsRetry(tx *sqlx.Tx, buildID string) (*Build, error) {
+	parent, err := buildsFindByID(tx, buildID)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent.State != StateFailed {
+		return nil, ErrInvalidTransition
+	}
+
+	b := &Build{
+		Repository:    parent.Repository,
+		Branch:        parent.Branch,
+		Sha:           parent.Sha,
+		ParentBuildID: &parent.ID,
+		Attempt:       parent.Attempt + 1,
+	}
+	if err := buildsCreate(tx, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// buildsFail marks a build as failed, recording why it failed.
+func buildsFail(tx *sqlx.Tx, buildID string, reason FailureReason, message string) error {
+	var errMessage *string
+	if message != "" {
+		errMessage = &message
+	}
+
+	return buildsComplete(tx, buildID, `state = ?, failure_reason = ?, error = ?`, StateFailed, reason, errMessage)
+}
+
+// buildsFailureBreakdown returns the number of failed builds for the
+// repository, grouped by the reason they failed. Builds that failed without a
+// reason are counted as FailureReasonUnknown.
+func buildsFailureBreakdown(tx *sqlx.Tx, repository string, since time.Time) (map[FailureReason]int, error) {
+	const sql = `SELECT COALESCE(failure_reason, 'unknown') AS reason, count(*) AS count FROM builds
+WHERE repository = ?
+AND state = 'failed'
+AND completed_at >= ?
+GROUP BY reason`
+
+	var rows []struct {
+		Reason FailureReason `db:"reason"`
+		Count  int           `db:"count"`
+	}
+	if err := tx.Select(&rows, tx.Rebind(sql), repository, since); err != nil {
+		return nil, err
+	}
+
+	breakdown := make(map[FailureReason]int)
+	for _, r := range rows {
+		breakdown[r.Reason] = r.Count
+	}
+	return breakdown, nil
+}
+
+// buildsLatestForRepos returns the most recent build for each of the given
+// repositories in a single query. Repositories that don't have any builds are
+// absent from the map.
+func buildsLatestForRepos(tx *sqlx.Tx, repositories []string) (map[string]*Build, error) {
+	latest := make(map[string]*Build)
+	if len(repositories) == 0 {
+		return latest, nil
+	}
+
+	sql, args, err := sqlx.In(`SELECT DISTINCT ON (repository) * FROM builds
+WHERE repository IN (?)
+ORDER BY repository, created_at desc, seq desc`, repositories)
+	if err != nil {
+		return nil, err
+	}
+
+	var builds []*Build
+	if err := tx.Select(&builds, tx.Rebind(sql), args...); err != nil {
+		return nil, err
+	}
+
+	for _, b := range builds {
+		latest[b.Repository] = b
+	}
+	return latest, nil
+}
+
+// buildsLatestStateForShas returns the state of the most recent build of each
+// of the given shas in the repository. Shas that haven't been built are absent
+// from the map. Hex shas are matched case insensitively, and the map is keyed
+// by the normalized sha.
+func buildsLatestStateForShas(tx *sqlx.Tx, repository string, shas []string) (map[string]BuildState, error) {
+	states := make(map[string]BuildState)
+	if len(shas) == 0 {
+		return states, nil
+	}
+
+	normalized := make([]string, len(shas))
+	for i, sha := range shas {
+		normalized[i] = normalizeSha(sha)
+	}
+
+	sql, args, err := sqlx.In(`SELECT DISTINCT ON (sha) sha, state FROM builds
+WHERE repository = ?
+AND sha IN (?)
+ORDER BY sha, created_at desc, seq desc`, repository, normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Sha   string     `db:"sha"`
+		State BuildState `db:"state"`
+	}
+	if err := tx.Select(&rows, tx.Rebind(sql), args...); err != nil {
+		return nil, err
+	}
+
+	for _, r := range rows {
+		states[r.Sha] = r.State
+	}
+	return states, nil
+}
+
+// DuplicateGroup is a set of active builds for the same sha, which the
+// unique_build index should have prevented.
+type DuplicateGroup struct {
+	Repository string
+	Branch     string
+	Sha        string
+	// The ids of the active builds, oldest first.
+	BuildIDs []string
+}
+
+// buildsFindDuplicateActive returns every repository, branch and sha that has
+// more than one pending or building build. It's meant to be run to audit the
+// data after a migration that touches the unique_build index. It doesn't modify
+// anything.
+func buildsFindDuplicateActive(tx *sqlx.Tx) ([]DuplicateGroup, error) {
+	const sql = `SELECT repository, COALESCE(branch, '') AS branch, sha, string_agg(id::text, ',' ORDER BY created_at, seq) AS build_ids FROM builds
+WHERE state IN ('pending', 'building')
+GROUP BY repository, branch, sha
+HAVING count(*) > 1
+ORDER BY repository, branch, sha`
+	var rows []struct {
+		Repository string `db:"repository"`
+		Branch     string `db:"branch"`
+		Sha        string `db:"sha"`
+		BuildIDs   string `db:"build_ids"`
+	}
+	if err := tx.Select(&rows, sql); err != nil {
+		return nil, err
+	}
+
+	var groups []DuplicateGroup
+	for _, r := range rows {
+		groups = append(groups, DuplicateGroup{
+			Repository: r.Repository,
+			Branch:     r.Branch,
+			Sha:        r.Sha,
+			BuildIDs:   strings.Split(r.BuildIDs, ","),
+		})
+	}
+	return groups, nil
+}
+
+// escapeLike escapes the wildcard characters in s so that it's matched
+// literally within a LIKE pattern.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ThroughputBucket is the number of builds that were created within a window
+// of time.
+type ThroughputBucket struct {
+	// The start of the window.
+	Start time.Time `db:"start"`
+	// The number of builds created within the window.
+	Count int `db:"count"`
+}
+
+// buildsThroughput returns the number of builds created for the repository
+// between from and to, grouped into buckets of the given size. Buckets without
+// any builds are included with a count of 0. Only hourly and daily buckets are
+// supported.
+func buildsThroughput(tx *sqlx.Tx, repository string, from, to time.Time, bucket time.Duration) ([]ThroughputBucket, error) {
+	var unit string
+	switch bucket {
+	case time.Hour:
+		unit = "hour"
+	case 24 * time.Hour:
+		unit = "day"
+	default:
+		return nil, fmt.Errorf("unsupported bucket size: %v", bucket)
+	}
+
+	from, to = from.UTC(), to.UTC()
+
+	const sql = `SELECT date_trunc(?, created_at) AS start, count(*) AS count FROM builds
+WHERE repository = ?
+AND created_at >= ?
+AND created_at < ?
+GROUP BY start`
+	var rows []ThroughputBucket
+	if err := tx.Select(&rows, tx.Rebind(sql), unit, repository, from, to); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[int64]int)
+	for _, r := range rows {
+		counts[r.Start.Unix()] = r.Count
+	}
+
+	var buckets []ThroughputBucket
+	for start := from.Truncate(bucket); start.Before(to); start = start.Add(bucket) {
+		buckets = append(buckets, ThroughputBucket{
+			Start: start,
+			Count: counts[start.Unix()],
+		})
+	}
+	return buckets, nil
+}
+
+// buildsStaleBuilding returns builds that have been building for longer than
+// olderThan, oldest first. It doesn't modify the builds. It's meant to be used
+// to alert on builds that may have been orphaned by a worker.
+func buildsStaleBuilding(tx *sqlx.Tx, olderThan time.Duration) ([]*Build, error) {
+	const sql = `SELECT * FROM builds
+WHERE state = 'building'
+AND started_at < ?
+ORDER BY started_at`
+	var builds []*Build
+	err := tx.Select(&builds, tx.Rebind(sql), time.Now().UTC().Add(-olderThan))
+	return builds, err
+}
+
+// buildsFailingBranches returns the latest build for each branch of the
+// repository, for the branches where that build failed. Cancelled builds
+// didn't fail on their own, so they're skipped when finding the latest build.
+func buildsFailingBranches(tx *sqlx.Tx, repository string) ([]*Build, error) {
+	const sql = `SELECT * FROM (
+	SELECT DISTINCT ON (branch) * FROM builds
+	WHERE repository = ?
+	AND failure_reason IS DISTINCT FROM 'cancelled'
+	ORDER BY branch, created_at desc, seq desc
+) AS latest
+WHERE state = 'failed'
+ORDER BY branch`
+	var builds []*Build
+	err := tx.Select(&builds, tx.Rebind(sql), repository)
+	return builds, err
+}
+
+// buildsRecentlyCompleted returns up to limit builds for the repository that
+// have completed, most recently completed first.
+func buildsRecentlyCompleted(tx *sqlx.Tx, repository string, limit int) ([]*Build, error) {
+	const sql = `SELECT * FROM builds
+WHERE repository = ?
+AND completed_at IS NOT NULL
+ORDER BY completed_at desc, seq desc
+LIMIT ?`
+	var builds []*Build
+	err := tx.Select(&builds, tx.Rebind(sql), repository, limit)
+	return builds, err
+}
+
+// buildsRenameRepository moves all builds and artifacts for a repository to a
+// new name, like when a repo is renamed or transferred on GitHub. It returns
+// the number of builds that were moved.
+//
+// The unique_build index only covers the sha, so a rename can never conflict
+// with an active build under the new name.
+func buildsRenameRepository(tx *sqlx.Tx, oldName, newName string) (int, error) {
+	const renameBuildsSql = `UPDATE builds SET repository = ? WHERE repository = ?`
+	res, err := tx.Exec(tx.Rebind(renameBuildsSql), newName, oldName)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	const renameArtifactsSql = `UPDATE artifacts SET repository = ? WHERE repository = ?`
+	if _, err := tx.Exec(tx.Rebind(renameArtifactsSql), newName, oldName); err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// buildsMTTR returns the mean time to recovery for a branch: the average time
+// between the first failed build on the branch and the next succeeded build,
+// for builds completed since the given time. Consecutive failures are treated
+// as a single red period. The number of recoveries that were averaged is also
+// returned. Failures that haven't been followed by a success yet are excluded,
+// and so are cancelled builds, since they don't make the branch red.
+func buildsMTTR(tx *sqlx.Tx, repository, branch string, since time.Time) (time.Duration, int, error) {
+	branch, err := normalizeBranch(branch)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	const sql = `SELECT * FROM builds
+WHERE repository = ?
+AND branch = ?
+AND state IN ('failed', 'succeeded')
+AND failure_reason IS DISTINCT FROM 'cancelled'
+AND completed_at >= ?
+ORDER BY completed_at, seq`
+	var builds []*Build
+	if err := tx.Select(&builds, tx.Rebind(sql), repository, branch, since); err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		total      time.Duration
+		recoveries int
+		redSince   *time.Time
+	)
+	for _, b := range builds {
+		switch b.State {
+		case StateFailed:
+			if redSince == nil {
+				redSince = b.CompletedAt
+			}
+		case StateSucceeded:
+			if redSince != nil {
+				total += b.CompletedAt.Sub(*redSince)
+				recoveries++
+				redSince = nil
+			}
+		}
+	}
+
+	if recoveries == 0 {
+		return 0, 0, nil
+	}
+
+	return total / time.Duration(recoveries), recoveries, nil
+}
+
+// buildsStuckPending returns builds that have been pending for longer than
+// olderThan, oldest first. It doesn't modify the builds. Builds that never get
+// started usually mean that no workers are pulling from the queue.
+func buildsStuckPending(tx *sqlx.Tx, olderThan time.Duration) ([]*Build, error) {
+	const sql = `SELECT * FROM builds
+WHERE state = 'pending'
+AND created_at < ?
+ORDER BY created_at`
+	var builds []*Build
+	err := tx.Select(&builds, tx.Rebind(sql), time.Now().UTC().Add(-olderThan))
+	return builds, err
+}
+
+// buildsGroupedByState returns up to perState of the most recent builds for the
+// repository in each state, newest first. Every state is present in the map,
+// with an empty slice if there are no builds in that state.
+func buildsGroupedByState(tx *sqlx.Tx, repository string, perState int) (map[BuildState][]*Build, error) {
+	const sql = `SELECT builds.* FROM builds
+JOIN (
+	SELECT id, ROW_NUMBER() OVER (PARTITION BY state ORDER BY created_at desc, seq desc) AS n FROM builds
+	WHERE repository = ?
+) AS ranked USING (id)
+WHERE ranked.n <= ?
+ORDER BY created_at desc, seq desc`
+	var builds []*Build
+	if err := tx.Select(&builds, tx.Rebind(sql), repository, perState); err != nil {
+		return nil, err
+	}
+
+	grouped := map[BuildState][]*Build{
+		StatePending:   {},
+		StateBuilding:  {},
+		StateFailed:    {},
+		StateSucceeded: {},
+	}
+	for _, b := range builds {
+		grouped[b.State] = append(grouped[b.State], b)
+	}
+	return grouped, nil
+}
+
+// buildsBacklog returns the number of pending builds for each repository that
+// has any. Builds can't be scheduled or blocked, so every pending build is
+// waiting on a worker.
+func buildsBacklog(tx *sqlx.Tx) (map[string]int, error) {
+	const sql = `SELECT repository, count(*) AS count FROM builds
+WHERE state = 'pending'
+GROUP BY repository`
+	var rows []struct {
+		Repository string `db:"repository"`
+		Count      int    `db:"count"`
+	}
+	if err := tx.Select(&rows, sql); err != nil {
+		return nil, err
+	}
+
+	backlog := make(map[string]int)
+	for _, r := range rows {
+		backlog[r.Repository] = r.Count
+	}
+	return backlog, nil
+}
+
+// buildsActivityHeatmap returns the number of builds created for the
+// repository since the given time, by day of the week (with Sunday as 0) and
+// hour of the day in the given IANA timezone, like "America/Los_Angeles".
+func buildsActivityHeatmap(tx *sqlx.Tx, repository string, since time.Time, timezone string) ([7][24]int, error) {
+	const sql = `SELECT extract(dow FROM local_created_at)::int AS dow, extract(hour FROM local_created_at)::int AS hour, count(*) AS count FROM (
+	SELECT (created_at AT TIME ZONE 'UTC') AT TIME ZONE ? AS local_created_at FROM builds
+	WHERE repository = ?
+	AND created_at >= ?
+) AS localized
+GROUP BY dow, hour`
+	var heatmap [7][24]int
+
+	var rows []struct {
+		Dow   int `db:"dow"`
+		Hour  int `db:"hour"`
+		Count int `db:"count"`
+	}
+	if err := tx.Select(&rows, tx.Rebind(sql), timezone, repository, since.UTC()); err != nil {
+		return heatmap, err
+	}
+
+	for _, r := range rows {
+		heatmap[r.Dow][r.Hour] = r.Count
+	}
+	return heatmap, nil
+}
+
+// buildsCancelBranch cancels the pending and building builds for a branch, like
+// when the branch is force pushed and they're for commits that no longer exist.
+// The build for exceptSha, if given, is left alone. Cancelled builds are failed
+// with FailureReasonCancelled. It returns the number of builds that were
+// cancelled.
+func buildsCancelBranch(tx *sqlx.Tx, repository, branch string, exceptSha string) (int, error) {
+	branch, err := normalizeBranch(branch)
+	if err != nil {
+		return 0, err
+	}
+
+	const sql = `UPDATE builds SET state = ?, failure_reason = ?, completed_at = GREATEST(?, started_at)
+WHERE repository = ?
+AND branch = ?
+AND state IN ('pending', 'building')
+AND sha <> ?`
+	res, err := tx.Exec(tx.Rebind(sql), StateFailed, FailureReasonCancelled, time.Now().UTC(), repository, branch, normalizeSha(exceptSha))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// SLOResult is how well builds met a queue time target.
+type SLOResult struct {
+	// The number of builds that were counted.
+	Sampled int
+	// The number of builds that started within the target.
+	WithinTarget int
+	// The fraction of the sampled builds that started within the target,
+	// or 1 if no builds were sampled.
+	Compliance float64
+	// The 95th percentile of the time between a build being created and
+	// started, for builds that started.
+	P95 time.Duration
+}
+
+// buildsQueueSLO measures how many builds for the repository created since the
+// given time started within target of being created. Builds that never started,
+// because they're still pending or were cancelled first, are excluded unless
+// unstartedBreach is true, in which case the ones that have waited longer than
+// target count as breaches.
+func buildsQueueSLO(tx *sqlx.Tx, repository string, since time.Time, target time.Duration, unstartedBreach bool) (SLOResult, error) {
+	const sql = `SELECT
+	count(started_at) AS started,
+	count(*) FILTER (WHERE extract(epoch FROM started_at - created_at) <= ?) AS within_target,
+	count(*) FILTER (WHERE started_at IS NULL AND created_at < ?) AS unstarted_breaches,
+	COALESCE(extract(epoch FROM percentile_cont(0.95) WITHIN GROUP (ORDER BY started_at - created_at)), 0) AS p95
+FROM builds
+WHERE repository = ?
+AND created_at >= ?`
+	var row struct {
+		Started           int     `db:"started"`
+		WithinTarget      int     `db:"within_target"`
+		UnstartedBreaches int     `db:"unstarted_breaches"`
+		P95               float64 `db:"p95"`
+	}
+	if err := tx.Get(&row, tx.Rebind(sql), target.Seconds(), time.Now().UTC().Add(-target), repository, since.UTC()); err != nil {
+		return SLOResult{}, err
+	}
+
+	result := SLOResult{
+		Sampled:      row.Started,
+		WithinTarget: row.WithinTarget,
+		Compliance:   1,
+		P95:          time.Duration(row.P95 * float64(time.Second)),
+	}
+	if unstartedBreach {
+		result.Sampled += row.UnstartedBreaches
+	}
+	if result.Sampled > 0 {
+		result.Compliance = float64(result.WithinTarget) / float64(result.Sampled)
+	}
+	return result, nil
+}
+
+// BranchActivity is the most recent build activity on a branch.
+type BranchActivity struct {
+	Branch string `db:"branch"`
+	// The time that the latest build for the branch was created.
+	LatestAt time.Time `db:"latest_at"`
+	// The state of the latest build for the branch.
+	State BuildState `db:"state"`
+}
+
+// buildsActiveBranches returns the branches of the repository that have had
+// builds created since the given time, most recently active first.
+func buildsActiveBranches(tx *sqlx.Tx, repository string, since time.Time) ([]BranchActivity, error) {
+	const sql = `SELECT branch, latest_at, state FROM (
+	SELECT DISTINCT ON (branch) branch, created_at AS latest_at, state, seq FROM builds
+	WHERE repository = ?
+	AND branch IS NOT NULL
+	AND created_at >= ?
+	ORDER BY branch, created_at desc, seq desc
+) AS latest
+ORDER BY latest_at desc, seq desc`
+	var branches []BranchActivity
+	err := tx.Select(&branches, tx.Rebind(sql), repository, since.UTC())
+	return branches, err
+}
+
+// buildsMergeDuplicates consolidates duplicate builds into one, like the ones
+// found by buildsFindDuplicateActive. Artifacts, build artifacts and retries of
+// the merged builds are moved to the kept build, and then the merged builds are
+// deleted. The kept build must be pending or building, and the merged builds
+// must be for the same repository and sha.
+func buildsMergeDuplicates(tx *sqlx.Tx, keepBuildID string, mergeBuildIDs []string) error {
+	keep, err := buildsFindByID(tx, keepBuildID)
+	if err != nil {
+		return err
+	}
+
+	switch keep.State {
+	case StatePending, StateBuilding:
+	default:
+		return fmt.Errorf("cannot merge builds into a %s build", keep.State)
+	}
+
+	seen := make(map[string]bool)
+	var ids []string
+	for _, id := range mergeBuildIDs {
+		id = strings.ToLower(id)
+		if id == keep.ID {
+			return errors.New("cannot merge a build into itself")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	merged, missing, err := buildsFindByIDs(tx, ids)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("cannot merge builds that don't exist: %s", strings.Join(missing, ", "))
+	}
+
+	for _, id := range ids {
+		b := merged[id]
+		if b.Repository != keep.Repository || b.Sha != keep.Sha {
+			return fmt.Errorf("cannot merge build %s for %s@%s into a build for %s@%s", b.ID, b.Repository, b.Sha, keep.Repository, keep.Sha)
+		}
+	}
+
+	// If the kept build is a retry of a merged build, it takes over that
+	// build's parent, rather than becoming its own parent.
+	parent := keep.ParentBuildID
+	for parent != nil && seen[*parent] {
+		parent = merged[*parent].ParentBuildID
+	}
+
+	for _, q := range []string{
+		`UPDATE artifacts SET build_id = ? WHERE build_id IN (?)`,
+		`UPDATE build_artifacts SET build_id = ? WHERE build_id IN (?)`,
+		`UPDATE builds SET parent_build_id = ? WHERE parent_build_id IN (?)`,
+	} {
+		sql, args, err := sqlx.In(q, keep.ID, ids)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(tx.Rebind(sql), args...); err != nil {
+			return err
+		}
+	}
+
+	const parentSql = `UPDATE builds SET parent_build_id = ? WHERE id = ?`
+	if _, err := tx.Exec(tx.Rebind(parentSql), parent, keep.ID); err != nil {
+		return err
+	}
+
+	sql, args, err := sqlx.In(`DELETE FROM builds WHERE id IN (?)`, ids)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(tx.Rebind(sql), args...)
+	return err
+}
+
+// buildsExportQueue returns every pending and building build, oldest first,
+// so that the queue can be restored into another database with
+// buildsImportQueue.
+func buildsExportQueue(tx *sqlx.Tx) ([]*Build, error) {
+	const sql = `SELECT * FROM builds
+WHERE state IN ('pending', 'building')
+ORDER BY created_at, seq`
+	var builds []*Build
+	err := tx.Select(&builds, sql)
+	return builds, err
+}
+
+// buildsImportQueue inserts builds exported with buildsExportQueue, keeping
+// their ids and created_at. Builds that were building are imported as pending,
+// so that they get run again. Builds that would conflict with an existing build
+// are skipped. The builds that retried are finished, so they aren't exported;
+// parent_build_id is only kept if the parent is already in this database. The
+// imported builds are returned; it's up to the caller to push them onto the
+// BuildQueue.
+func buildsImportQueue(tx *sqlx.Tx, builds []*Build) ([]*Build, error) {
+	const importBuildSql = `INSERT INTO builds (id, repository, branch, sha, state, created_at, idempotency_key, parent_build_id, attempt) VALUES (:id, :repository, :branch, :sha, :state, :created_at, :idempotency_key, (SELECT id FROM builds WHERE id = CAST(:parent_build_id AS uuid)), :attempt)
+ON CONFLICT DO NOTHING
+RETURNING seq, parent_build_id`
+
+	var imported []*Build
+	for _, exported := range builds {
+		b := *exported
+		b.State = StatePending
+		b.StartedAt = nil
+
+		rows, err := tx.NamedQuery(importBuildSql, &b)
+		if err != nil {
+			return nil, err
+		}
+
+		inserted := rows.Next()
+		if inserted {
+			err = rows.Scan(&b.Seq, &b.ParentBuildID)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if inserted {
+			imported = append(imported, &b)
+		}
+	}
+
+	return imported, nil
+}
+
+// RunningBuild is a build that's in progress, along with how long it's been
+// running.
+type RunningBuild struct {
+	*Build
+	// How long the build had been running when it was queried.
+	Elapsed time.Duration
+}
+
+// buildsLongestRunning returns, for each repository with a build in progress,
+// the build that's been building the longest. Repositories without any
+// building builds are absent from the map.
+func buildsLongestRunning(tx *sqlx.Tx) (map[string]*RunningBuild, error) {
+	const sql = `SELECT DISTINCT ON (repository) *, EXTRACT(EPOCH FROM CAST(? AS timestamp) - started_at) AS elapsed_seconds FROM builds
+WHERE state = 'building'
+ORDER BY repository, started_at, seq`
+	var rows []struct {
+		Build
+		ElapsedSeconds float64 `db:"elapsed_seconds"`
+	}
+	if err := tx.Select(&rows, tx.Rebind(sql), time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	longest := make(map[string]*RunningBuild)
+	for i := range rows {
+		r := &rows[i]
+		longest[r.Repository] = &RunningBuild{
+			Build:   &r.Build,
+			Elapsed: time.Duration(r.ElapsedSeconds * float64(time.Second)),
+		}
+	}
+	return longest, nil
+}
+
+// buildsSinceLastGreen returns the builds on a branch that were created after
+// the most recent succeeded build on it, oldest first. If the branch has never
+// had a succeeded build, all of its builds are returned.
+func buildsSinceLastGreen(tx *sqlx.Tx, repository, branch string) ([]*Build, error) {
+	branch, err := normalizeBranch(branch)
+	if err != nil {
+		return nil, err
+	}
+
+	const sql = `WITH green AS (
+	SELECT created_at, seq FROM builds
+	WHERE repository = ?
+	AND branch = ?
+	AND state = 'succeeded'
+	ORDER BY created_at desc, seq desc
+	LIMIT 1
+)
+SELECT * FROM builds
+WHERE repository = ?
+AND branch = ?
+AND NOT EXISTS (
+	SELECT 1 FROM green WHERE (builds.created_at, builds.seq) <= (green.created_at, green.seq)
+)
+ORDER BY created_at, seq`
+	var builds []*Build
+	err = tx.Select(&builds, tx.Rebind(sql), repository, branch, repository, branch)
+	return builds, err
+}
+
+// buildsReposWithoutRecentSuccess returns the repositories that have builds,
+// but haven't had a build succeed within the given window, sorted by name.
+// These are likely to be broken, rather than just inactive. Like the other
+// queries on completed_at, the window is measured in UTC.
+func buildsReposWithoutRecentSuccess(tx *sqlx.Tx, within time.Duration) ([]string, error) {
+	const sql = `SELECT repository FROM builds
+GROUP BY repository
+HAVING NOT COALESCE(bool_or(state = 'succeeded' AND completed_at >= ?), false)
+ORDER BY repository`
+	var repos []string
+	err := tx.Select(&repos, tx.Rebind(sql), time.Now().UTC().Add(-within))
+	return repos, err
+}
+
+// buildsSupersede cancels the active build for the sha, if there is one, and
+// creates newBuild as a new pending build for the same commit, like when a
+// user asks to rebuild a commit now. The cancelled build is failed with
+// FailureReasonCancelled, so unique_build doesn't conflict with the new build.
+// Like buildsRetry, it's up to the caller to push the new build onto the
+// BuildQueue, like Conveyor.SupersedeBuild does.
+func buildsSupersede(tx *sqlx.Tx, repository, branch, sha string, newBuild *Build) (*Build, error) {
+	sha = normalizeSha(sha)
+
+	const sql = `UPDATE builds SET state = ?, failure_reason = ?, completed_at = GREATEST(?, started_at)
+WHERE repository = ?
+AND sha = ?
+AND state IN ('pending', 'building')`
+	if _, err := tx.Exec(tx.Rebind(sql), StateFailed, FailureReasonCancelled, time.Now().UTC(), repository, sha); err != nil {
+		return nil, err
+	}
+
+	newBuild.Repository = repository
+	newBuild.Branch = branch
+	newBuild.Sha = sha
+	newBuild.State = StatePending
+	newBuild.StartedAt = nil
+
+	if err := buildsCreate(tx, newBuild); err != nil {
+		return nil, err
+	}
+
+	return newBuild, nil
+}
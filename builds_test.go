@@ -0,0 +1,1603 @@
+package conveyor
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild_JSON(t *testing.T) {
+	createdAt := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	startedAt := createdAt.Add(time.Minute)
+	completedAt := startedAt.Add(5 * time.Minute)
+	errMessage := "container returned a non-zero exit code: 1"
+	idempotencyKey := "abcd"
+	parentBuildID := "76543210-89ab-cdef-0123-456789abcdef"
+
+	tests := []struct {
+		build Build
+		json  string
+	}{
+		{
+			Build{
+				ID:         fakeUUID,
+				Seq:        1,
+				Repository: "remind101/acme-inc",
+				Branch:     "master",
+				Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+				State:      StatePending,
+				CreatedAt:  createdAt,
+				Attempt:    1,
+			},
+			`{"id":"01234567-89ab-cdef-0123-456789abcdef","seq":1,"repository":"remind101/acme-inc","branch":"master","sha":"139759bd61e98faeec619c45b1060b4288952164","state":"pending","created_at":"2015-01-01T00:00:00Z","started_at":null,"completed_at":null,"failure_reason":"","error":null,"idempotency_key":null,"parent_build_id":null,"attempt":1}`,
+		},
+		{
+			Build{
+				ID:             fakeUUID,
+				Seq:            2,
+				Repository:     "remind101/acme-inc",
+				Branch:         "master",
+				Sha:            "139759bd61e98faeec619c45b1060b4288952164",
+				State:          StateFailed,
+				CreatedAt:      createdAt,
+				StartedAt:      &startedAt,
+				CompletedAt:    &completedAt,
+				FailureReason:  FailureReasonTimeout,
+				Error:          &errMessage,
+				IdempotencyKey: &idempotencyKey,
+				ParentBuildID:  &parentBuildID,
+				Attempt:        2,
+			},
+			`{"id":"01234567-89ab-cdef-0123-456789abcdef","seq":2,"repository":"remind101/acme-inc","branch":"master","sha":"139759bd61e98faeec619c45b1060b4288952164","state":"failed","created_at":"2015-01-01T00:00:00Z","started_at":"2015-01-01T00:01:00Z","completed_at":"2015-01-01T00:06:00Z","failure_reason":"timeout","error":"container returned a non-zero exit code: 1","idempotency_key":"abcd","parent_build_id":"76543210-89ab-cdef-0123-456789abcdef","attempt":2}`,
+		},
+	}
+
+	for _, tt := range tests {
+		raw, err := json.Marshal(tt.build)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.json, string(raw))
+
+		var b Build
+		assert.NoError(t, json.Unmarshal(raw, &b))
+		roundtrip, err := json.Marshal(b)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.json, string(roundtrip))
+	}
+}
+
+func TestBuildState_JSON(t *testing.T) {
+	var s BuildState
+	assert.NoError(t, json.Unmarshal([]byte(`"succeeded"`), &s))
+	assert.Equal(t, StateSucceeded, s)
+	assert.EqualError(t, json.Unmarshal([]byte(`"unknown"`), &s), "unknown build state: unknown")
+}
+
+func TestBuild_Timestamps(t *testing.T) {
+	b := &Build{}
+	assert.False(t, b.HasStarted())
+	assert.False(t, b.HasCompleted())
+	assert.True(t, b.StartedAtOrZero().IsZero())
+	assert.True(t, b.CompletedAtOrZero().IsZero())
+	_, ok := b.Duration()
+	assert.False(t, ok)
+
+	startedAt := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	completedAt := startedAt.Add(5 * time.Minute)
+	b.StartedAt = &startedAt
+	b.CompletedAt = &completedAt
+	assert.True(t, b.HasStarted())
+	assert.True(t, b.HasCompleted())
+	assert.Equal(t, startedAt, b.StartedAtOrZero())
+	assert.Equal(t, completedAt, b.CompletedAtOrZero())
+
+	d, ok := b.Duration()
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, d)
+}
+
+func TestFormatBuildDuration(t *testing.T) {
+	tests := []struct {
+		d   time.Duration
+		ok  bool
+		out string
+	}{
+		{0, true, "0s"},
+		{482 * time.Microsecond, true, "0s"},
+		{13*time.Second + 600*time.Millisecond, true, "14s"},
+		{2*time.Minute + 13*time.Second + 482*time.Microsecond, true, "2m13s"},
+		{2*time.Minute + 3*time.Second, true, "2m03s"},
+		{time.Hour + 4*time.Minute + 59*time.Second, true, "1h04m"},
+		{26 * time.Hour, true, "26h00m"},
+		{time.Minute, false, "running"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.out, FormatBuildDuration(tt.d, tt.ok))
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to BuildState
+		ok       bool
+	}{
+		{StatePending, StateBuilding, true},
+		{StatePending, StateSucceeded, true},
+		{StatePending, StateFailed, true},
+		{StateBuilding, StateSucceeded, true},
+		{StateBuilding, StateFailed, true},
+		{StateBuilding, StatePending, false},
+		{StateFailed, StateSucceeded, false},
+		{StateSucceeded, StateBuilding, false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.ok, canTransition(tt.from, tt.to), "%s -> %s", tt.from, tt.to)
+	}
+}
+
+func TestBuildsImport(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	createdAt := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	startedAt := createdAt.Add(time.Minute)
+	completedAt := startedAt.Add(5 * time.Minute)
+
+	b := &Build{
+		Repository:  "remind101/acme-inc",
+		Branch:      "master",
+		Sha:         "139759bd61e98faeec619c45b1060b4288952164",
+		State:       StateSucceeded,
+		CreatedAt:   createdAt,
+		StartedAt:   &startedAt,
+		CompletedAt: &completedAt,
+	}
+	err := buildsImport(tx, b)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "", b.ID)
+
+	b, err = buildsFindByID(tx, b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StateSucceeded, b.State)
+	assert.Equal(t, createdAt, b.CreatedAt.UTC())
+	assert.Equal(t, completedAt, b.CompletedAt.UTC())
+}
+
+func TestBuildsImport_Invalid(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	err := buildsImport(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+		State:      StatePending,
+		CreatedAt:  time.Now(),
+	})
+	assert.EqualError(t, err, "cannot import a build in the pending state")
+
+	err = buildsImport(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+		State:      StateFailed,
+		CreatedAt:  time.Now(),
+	})
+	assert.EqualError(t, err, "cannot import a failed build without a completed_at")
+
+	startedAt := time.Now()
+	completedAt := startedAt.Add(-time.Minute)
+	err = buildsImport(tx, &Build{
+		Repository:  "remind101/acme-inc",
+		Sha:         "139759bd61e98faeec619c45b1060b4288952164",
+		State:       StateSucceeded,
+		CreatedAt:   startedAt,
+		StartedAt:   &startedAt,
+		CompletedAt: &completedAt,
+	})
+	assert.EqualError(t, err, "cannot import a build that completed before it started")
+}
+
+func TestBuildsComplete_ClockSkew(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+
+	// The worker that started the build is an hour ahead.
+	startedAt := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	tx.MustExec(tx.Rebind(`UPDATE builds SET state = 'building', started_at = ? WHERE id = ?`), startedAt, b.ID)
+
+	assert.NoError(t, buildsUpdateState(tx, b.ID, StateSucceeded))
+
+	b, err := buildsFindByID(tx, b.ID)
+	assert.NoError(t, err)
+	d, ok := b.Duration()
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), d)
+}
+
+func TestBuildsFailureBreakdown(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	since := time.Now().Add(-time.Hour)
+	for _, reason := range []FailureReason{FailureReasonTimeout, FailureReasonTimeout, ""} {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		assert.NoError(t, buildsFail(tx, b.ID, reason, "boom"))
+	}
+
+	breakdown, err := buildsFailureBreakdown(tx, "remind101/acme-inc", since)
+	assert.NoError(t, err)
+	assert.Equal(t, map[FailureReason]int{
+		FailureReasonTimeout: 2,
+		FailureReasonUnknown: 1,
+	}, breakdown)
+}
+
+func TestBuildsLatestForRepos(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	var last *Build
+	for _, sha := range []string{"139759bd61e98faeec619c45b1060b4288952164", "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f"} {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        sha,
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		last = b
+	}
+
+	latest, err := buildsLatestForRepos(tx, []string{"remind101/acme-inc", "remind101/empire"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(latest))
+	assert.Equal(t, last.ID, latest["remind101/acme-inc"].ID)
+}
+
+func TestValidateSha(t *testing.T) {
+	assert.NoError(t, validateSha("139759bd61e98faeec619c45b1060b4288952164"))
+	assert.NoError(t, validateSha("139759BD"))
+	assert.Equal(t, ErrInvalidSha, validateSha("139759bz"))
+	assert.Equal(t, ErrInvalidSha, validateSha("master"))
+}
+
+func TestEscapeLike(t *testing.T) {
+	assert.Equal(t, "abcd", escapeLike("abcd"))
+	assert.Equal(t, `100\%\_done\\`, escapeLike(`100%_done\`))
+}
+
+func TestBuildsThroughput(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	for _, sha := range []string{"139759bd61e98faeec619c45b1060b4288952164", "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f"} {
+		assert.NoError(t, buildsCreate(tx, &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        sha,
+		}))
+	}
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	buckets, err := buildsThroughput(tx, "remind101/acme-inc", now.Add(-2*time.Hour), now.Add(time.Hour), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(buckets))
+	assert.Equal(t, now.Add(-2*time.Hour), buckets[0].Start)
+
+	var total int
+	for _, b := range buckets {
+		total += b.Count
+	}
+	assert.Equal(t, 2, total)
+
+	_, err = buildsThroughput(tx, "remind101/acme-inc", now, now, time.Minute)
+	assert.EqualError(t, err, "unsupported bucket size: 1m0s")
+}
+
+func TestBuildsStaleBuilding(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+	assert.NoError(t, buildsUpdateState(tx, b.ID, StateBuilding))
+
+	builds, err := buildsStaleBuilding(tx, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(builds))
+
+	builds, err = buildsStaleBuilding(tx, -time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(builds))
+	assert.Equal(t, b.ID, builds[0].ID)
+	assert.NotNil(t, builds[0].StartedAt)
+}
+
+func TestBuildsStuckPending(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+
+	started := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	}
+	assert.NoError(t, buildsCreate(tx, started))
+	assert.NoError(t, buildsUpdateState(tx, started.ID, StateBuilding))
+
+	builds, err := buildsStuckPending(tx, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(builds))
+
+	builds, err = buildsStuckPending(tx, -time.Minute)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(builds)) {
+		assert.Equal(t, b.ID, builds[0].ID)
+	}
+}
+
+func BenchmarkCreate(b *testing.B) {
+	c := newConveyor(b)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := buildsCreate(tx, &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        fmt.Sprintf("%040x", i),
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	c := newConveyor(b)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	build := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	if err := buildsCreate(tx, build); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := buildsFindByID(tx, build.ID); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdateState(b *testing.B) {
+	c := newConveyor(b)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	build := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	if err := buildsCreate(tx, build); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := buildsUpdateState(tx, build.ID, StateBuilding); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBuildsFailingBranches(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	builds := []struct {
+		branch, sha string
+		state       BuildState
+	}{
+		{"master", "139759bd61e98faeec619c45b1060b4288952164", StateFailed},
+		{"master", "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f", StateSucceeded},
+		{"feature", "2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2", StateSucceeded},
+		{"feature", "8d4a5a8e3e21d53b7f2f8a3b5c3e4d7e6f1a2b3c", StateFailed},
+	}
+	for _, tt := range builds {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     tt.branch,
+			Sha:        tt.sha,
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		assert.NoError(t, buildsUpdateState(tx, b.ID, tt.state))
+	}
+
+	// Cancelled builds don't make a branch fail.
+	for i, branch := range []string{"master", "force-pushed"} {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     branch,
+			Sha:        fmt.Sprintf("%040x", i),
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		assert.NoError(t, buildsFail(tx, b.ID, FailureReasonCancelled, ""))
+	}
+
+	failing, err := buildsFailingBranches(tx, "remind101/acme-inc")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(failing))
+	assert.Equal(t, "feature", failing[0].Branch)
+}
+
+func TestBuildsRecentlyCompleted(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		ts := now.Add(-d)
+		return &ts
+	}
+
+	// Created first, but completed last.
+	slow := &Build{
+		Repository:  "remind101/acme-inc",
+		Branch:      "master",
+		Sha:         "139759bd61e98faeec619c45b1060b4288952164",
+		State:       StateSucceeded,
+		CreatedAt:   *at(3 * time.Hour),
+		CompletedAt: at(time.Minute),
+	}
+	fast := &Build{
+		Repository:  "remind101/acme-inc",
+		Branch:      "master",
+		Sha:         "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+		State:       StateFailed,
+		CreatedAt:   *at(2 * time.Hour),
+		CompletedAt: at(time.Hour),
+	}
+	assert.NoError(t, buildsImport(tx, slow))
+	assert.NoError(t, buildsImport(tx, fast))
+
+	// Still pending, so it shouldn't show up.
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2",
+	}))
+
+	builds, err := buildsRecentlyCompleted(tx, "remind101/acme-inc", 10)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(builds)) {
+		assert.Equal(t, slow.ID, builds[0].ID)
+		assert.Equal(t, fast.ID, builds[1].ID)
+	}
+
+	builds, err = buildsRecentlyCompleted(tx, "remind101/acme-inc", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(builds))
+}
+
+func TestBuildsRenameRepository(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+	assert.NoError(t, buildsUpdateState(tx, b.ID, StateSucceeded))
+	assert.NoError(t, artifactsCreate(tx, &Artifact{
+		BuildID: b.ID,
+		Image:   "remind101/acme:139759bd61e98faeec619c45b1060b4288952164",
+	}))
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/acme",
+		Branch:     "master",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	}))
+
+	n, err := buildsRenameRepository(tx, "remind101/acme", "remind101/acme-inc")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	found, err := buildsFindByRepoSha(tx, "remind101/acme-inc@139759bd61e98faeec619c45b1060b4288952164")
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, found.ID)
+
+	a, err := artifactsFindByRepoSha(tx, "remind101/acme-inc@139759bd61e98faeec619c45b1060b4288952164")
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, a.BuildID)
+}
+
+func TestBuildsMTTR(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	start := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	builds := []struct {
+		sha    string
+		state  BuildState
+		offset time.Duration
+	}{
+		// Red for 30 minutes, across two failures.
+		{"139759bd61e98faeec619c45b1060b4288952164", StateFailed, 0},
+		{"c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f", StateFailed, 10 * time.Minute},
+		{"2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2", StateSucceeded, 30 * time.Minute},
+		// Cancelled, so the branch is still green.
+		{"0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c", StateFailed, 40 * time.Minute},
+		// Red for 10 minutes.
+		{"8d4a5a8e3e21d53b7f2f8a3b5c3e4d7e6f1a2b3c", StateFailed, time.Hour},
+		{"5f3b2a1c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a", StateSucceeded, time.Hour + 10*time.Minute},
+		// Still red, so it isn't counted.
+		{"9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d", StateFailed, 2 * time.Hour},
+	}
+	for _, tt := range builds {
+		completedAt := start.Add(tt.offset)
+		assert.NoError(t, buildsImport(tx, &Build{
+			Repository:  "remind101/acme-inc",
+			Branch:      "master",
+			Sha:         tt.sha,
+			State:       tt.state,
+			CreatedAt:   completedAt.Add(-time.Minute),
+			CompletedAt: &completedAt,
+		}))
+	}
+
+	tx.MustExec(tx.Rebind(`UPDATE builds SET failure_reason = ? WHERE sha = ?`), FailureReasonCancelled, "0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c")
+
+	mttr, n, err := buildsMTTR(tx, "remind101/acme-inc", "master", start.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 20*time.Minute, mttr)
+
+	_, n, err = buildsMTTR(tx, "remind101/acme-inc", "refs/heads/master", start.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	_, n, err = buildsMTTR(tx, "remind101/acme-inc", "feature", start.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestBuildsRetry(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+	assert.Equal(t, 1, b.Attempt)
+
+	// Pending builds can't be retried.
+	_, err := buildsRetry(tx, b.ID)
+	assert.Equal(t, ErrInvalidTransition, err)
+
+	assert.NoError(t, buildsFail(tx, b.ID, FailureReasonInfra, ""))
+
+	retry, err := buildsRetry(tx, b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatePending, retry.State)
+	assert.Equal(t, b.Sha, retry.Sha)
+	assert.Equal(t, b.ID, *retry.ParentBuildID)
+	assert.Equal(t, 2, retry.Attempt)
+
+	// Retrying fails while another build for the sha is active.
+	assert.NoError(t, buildsFail(tx, retry.ID, FailureReasonInfra, ""))
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}))
+	_, err = buildsRetry(tx, retry.ID)
+	assert.True(t, IsDuplicateBuild(err))
+}
+
+func TestBuildsArtifacts(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+	assert.NoError(t, buildsFail(tx, b.ID, FailureReasonTestFailure, ""))
+
+	artifacts, err := buildsArtifacts(tx, b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(artifacts))
+
+	// Failed builds can still have logs attached.
+	a := &BuildArtifact{
+		BuildID:     b.ID,
+		Name:        "test.log",
+		URL:         "https://s3.amazonaws.com/conveyor/test.log",
+		SizeBytes:   5 << 30,
+		ContentType: "text/plain",
+	}
+	assert.NoError(t, buildsAddArtifact(tx, a))
+	assert.NotEqual(t, "", a.ID)
+	assert.False(t, a.CreatedAt.IsZero())
+
+	artifacts, err = buildsArtifacts(tx, b.ID)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(artifacts)) {
+		assert.Equal(t, a.ID, artifacts[0].ID)
+		assert.Equal(t, int64(5<<30), artifacts[0].SizeBytes)
+	}
+	found, err := buildsByArtifactURL(tx, "https://s3.amazonaws.com/conveyor/test.log")
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, found.ID)
+
+	_, err = buildsByArtifactURL(tx, "https://s3.amazonaws.com/conveyor/other.log")
+	assert.Equal(t, ErrBuildNotFound, err)
+}
+
+func TestBuildsGroupedByState(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	var failed []*Build
+	for _, sha := range []string{
+		"139759bd61e98faeec619c45b1060b4288952164",
+		"c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+		"2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2",
+	} {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        sha,
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		assert.NoError(t, buildsUpdateState(tx, b.ID, StateFailed))
+		failed = append(failed, b)
+	}
+
+	pending := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "8d4a5a8e3e21d53b7f2f8a3b5c3e4d7e6f1a2b3c",
+	}
+	assert.NoError(t, buildsCreate(tx, pending))
+
+	grouped, err := buildsGroupedByState(tx, "remind101/acme-inc", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(grouped))
+	assert.Equal(t, 0, len(grouped[StateBuilding]))
+	assert.Equal(t, 0, len(grouped[StateSucceeded]))
+	if assert.Equal(t, 1, len(grouped[StatePending])) {
+		assert.Equal(t, pending.ID, grouped[StatePending][0].ID)
+	}
+	if assert.Equal(t, 2, len(grouped[StateFailed])) {
+		assert.Equal(t, failed[2].ID, grouped[StateFailed][0].ID)
+		assert.Equal(t, failed[1].ID, grouped[StateFailed][1].ID)
+	}
+}
+
+func TestBuildsHasActive(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+
+	tests := []struct {
+		branch, sha string
+		active      bool
+	}{
+		{"master", "139759bd61e98faeec619c45b1060b4288952164", true},
+		{"master", "139759BD61E98FAEEC619C45B1060B4288952164", true},
+		{"refs/heads/master", "139759bd61e98faeec619c45b1060b4288952164", true},
+		{"", "139759bd61e98faeec619c45b1060b4288952164", true},
+		{"feature", "139759bd61e98faeec619c45b1060b4288952164", false},
+		{"master", "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f", false},
+	}
+	for _, tt := range tests {
+		active, err := buildsHasActive(tx, "remind101/acme-inc", tt.branch, tt.sha)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.active, active)
+	}
+
+	assert.NoError(t, buildsUpdateState(tx, b.ID, StateSucceeded))
+	active, err := buildsHasActive(tx, "remind101/acme-inc", "master", b.Sha)
+	assert.NoError(t, err)
+	assert.False(t, active)
+}
+
+func TestBuildsLatestStateForShas(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	builds := []struct {
+		sha   string
+		state BuildState
+	}{
+		{"139759bd61e98faeec619c45b1060b4288952164", StateFailed},
+		{"139759bd61e98faeec619c45b1060b4288952164", StateSucceeded},
+		{"c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f", StateFailed},
+	}
+	for _, tt := range builds {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        tt.sha,
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		assert.NoError(t, buildsUpdateState(tx, b.ID, tt.state))
+	}
+
+	states, err := buildsLatestStateForShas(tx, "remind101/acme-inc", []string{
+		"139759BD61E98FAEEC619C45B1060B4288952164",
+		"c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+		"2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]BuildState{
+		"139759bd61e98faeec619c45b1060b4288952164": StateSucceeded,
+		"c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f": StateFailed,
+	}, states)
+
+	states, err = buildsLatestStateForShas(tx, "remind101/acme-inc", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(states))
+}
+
+func TestBuildsFindDuplicateActive(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	groups, err := buildsFindDuplicateActive(tx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(groups))
+
+	// Simulate the index having been dropped.
+	tx.MustExec(`DROP INDEX unique_build`)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		ids = append(ids, b.ID)
+	}
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	}))
+
+	groups, err = buildsFindDuplicateActive(tx)
+	assert.NoError(t, err)
+	assert.Equal(t, []DuplicateGroup{
+		{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+			BuildIDs:   ids,
+		},
+	}, groups)
+}
+
+func TestBuildsBacklog(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	builds := []struct {
+		repository, sha string
+		state           BuildState
+	}{
+		{"remind101/acme-inc", "139759bd61e98faeec619c45b1060b4288952164", StatePending},
+		{"remind101/acme-inc", "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f", StatePending},
+		{"remind101/acme-inc", "2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2", StateBuilding},
+		{"remind101/other", "8d4a5a8e3e21d53b7f2f8a3b5c3e4d7e6f1a2b3c", StateSucceeded},
+	}
+	for _, tt := range builds {
+		b := &Build{
+			Repository: tt.repository,
+			Branch:     "master",
+			Sha:        tt.sha,
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		if tt.state != StatePending {
+			assert.NoError(t, buildsUpdateState(tx, b.ID, tt.state))
+		}
+	}
+
+	backlog, err := buildsBacklog(tx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"remind101/acme-inc": 2}, backlog)
+}
+
+func TestBuildsFindByIDs(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+
+	found, missing, err := buildsFindByIDs(tx, []string{fakeUUID, b.ID, "not-a-uuid"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, b.Sha, found[b.ID].Sha)
+	assert.Equal(t, []string{fakeUUID, "not-a-uuid"}, missing)
+
+	found, missing, err = buildsFindByIDs(tx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(found))
+	assert.Equal(t, 0, len(missing))
+}
+
+func TestBuildsUpdateStateReturning(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+
+	updated, err := buildsUpdateStateReturning(tx, b.ID, StateBuilding)
+	assert.NoError(t, err)
+	assert.Equal(t, StateBuilding, updated.State)
+	assert.True(t, updated.HasStarted())
+	assert.False(t, updated.HasCompleted())
+
+	updated, err = buildsUpdateStateReturning(tx, b.ID, StateSucceeded)
+	assert.NoError(t, err)
+	assert.Equal(t, StateSucceeded, updated.State)
+	assert.True(t, updated.HasCompleted())
+
+	_, err = buildsUpdateStateReturning(tx, b.ID, StateFailed)
+	assert.Equal(t, ErrInvalidTransition, err)
+
+	_, err = buildsUpdateStateReturning(tx, fakeUUID, StateFailed)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestBuildsActivityHeatmap(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	// Thursday at 15:30 UTC, and Friday at 02:00 UTC.
+	thursday := time.Date(2015, 1, 1, 15, 30, 0, 0, time.UTC)
+	friday := time.Date(2015, 1, 2, 2, 0, 0, 0, time.UTC)
+	for i, createdAt := range []time.Time{thursday, thursday, friday} {
+		completedAt := createdAt.Add(time.Minute)
+		assert.NoError(t, buildsImport(tx, &Build{
+			Repository:  "remind101/acme-inc",
+			Branch:      "master",
+			Sha:         fmt.Sprintf("%040x", i),
+			State:       StateSucceeded,
+			CreatedAt:   createdAt,
+			CompletedAt: &completedAt,
+		}))
+	}
+
+	since := thursday.Add(-24 * time.Hour)
+
+	heatmap, err := buildsActivityHeatmap(tx, "remind101/acme-inc", since, "UTC")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, heatmap[time.Thursday][15])
+	assert.Equal(t, 1, heatmap[time.Friday][2])
+
+	// Friday at 02:00 UTC is still Thursday in New York.
+	heatmap, err = buildsActivityHeatmap(tx, "remind101/acme-inc", since, "America/New_York")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, heatmap[time.Thursday][10])
+	assert.Equal(t, 1, heatmap[time.Thursday][21])
+}
+
+func TestBuildsCancelBranch(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	builds := []struct {
+		branch, sha string
+		state       BuildState
+	}{
+		{"master", "139759bd61e98faeec619c45b1060b4288952164", StatePending},
+		{"master", "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f", StateBuilding},
+		{"master", "2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2", StatePending},
+		{"feature", "8d4a5a8e3e21d53b7f2f8a3b5c3e4d7e6f1a2b3c", StatePending},
+	}
+	var ids []string
+	for _, tt := range builds {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     tt.branch,
+			Sha:        tt.sha,
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		if tt.state != StatePending {
+			assert.NoError(t, buildsUpdateState(tx, b.ID, tt.state))
+		}
+		ids = append(ids, b.ID)
+	}
+
+	n, err := buildsCancelBranch(tx, "remind101/acme-inc", "refs/heads/master", "2A9C39BE2F1F2C6E1B4A69B8E8B7CBF44D7AD0A2")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	for i, state := range []BuildState{StateFailed, StateFailed, StatePending, StatePending} {
+		b, err := buildsFindByID(tx, ids[i])
+		assert.NoError(t, err)
+		assert.Equal(t, state, b.State)
+		if state == StateFailed {
+			assert.Equal(t, FailureReasonCancelled, b.FailureReason)
+			assert.True(t, b.HasCompleted())
+		}
+	}
+
+	// Completing a cancelled build doesn't resurrect it.
+	assert.NoError(t, buildsUpdateState(tx, ids[1], StateSucceeded))
+	b, err := buildsFindByID(tx, ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, StateFailed, b.State)
+
+	// Cancelled builds can't be started.
+	_, err = buildsStart(tx, ids[0])
+	assert.Equal(t, ErrInvalidTransition, err)
+}
+
+func TestBuildsResolveSha(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	var latest *Build
+	for _, sha := range []string{
+		"139759bd61e98faeec619c45b1060b4288952164",
+		"139759bd61e98faeec619c45b1060b4288952164",
+		"1397aaaa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	} {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        sha,
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		assert.NoError(t, buildsUpdateState(tx, b.ID, StateFailed))
+		if sha == "139759bd61e98faeec619c45b1060b4288952164" {
+			latest = b
+		}
+	}
+
+	b, err := buildsResolveSha(tx, "remind101/acme-inc", "13975")
+	assert.NoError(t, err)
+	assert.Equal(t, latest.ID, b.ID)
+
+	b, err = buildsResolveSha(tx, "remind101/acme-inc", "139759BD")
+	assert.NoError(t, err)
+	assert.Equal(t, latest.ID, b.ID)
+
+	_, err = buildsResolveSha(tx, "remind101/acme-inc", "1397")
+	assert.Equal(t, ErrAmbiguousSha, err)
+
+	_, err = buildsResolveSha(tx, "remind101/acme-inc", "ffff")
+	assert.Equal(t, ErrBuildNotFound, err)
+
+	_, err = buildsResolveSha(tx, "remind101/acme-inc", "139")
+	assert.Equal(t, ErrShaPrefixTooShort, err)
+
+	_, err = buildsResolveSha(tx, "remind101/acme-inc", "13_%")
+	assert.Equal(t, ErrInvalidSha, err)
+}
+
+func TestBuildsQueueSLO(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	createdAt := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+	for i, wait := range []time.Duration{30 * time.Second, time.Minute, 90 * time.Second, 5 * time.Minute} {
+		startedAt := createdAt.Add(wait)
+		completedAt := startedAt.Add(time.Minute)
+		assert.NoError(t, buildsImport(tx, &Build{
+			Repository:  "remind101/acme-inc",
+			Branch:      "master",
+			Sha:         fmt.Sprintf("%040x", i),
+			State:       StateSucceeded,
+			CreatedAt:   createdAt,
+			StartedAt:   &startedAt,
+			CompletedAt: &completedAt,
+		}))
+	}
+
+	// Still waiting for a worker after 10 minutes.
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+	tx.MustExec(tx.Rebind(`UPDATE builds SET created_at = ? WHERE id = ?`), time.Now().UTC().Add(-10*time.Minute), b.ID)
+
+	// Just created, so it hasn't breached yet.
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	}))
+
+	since := createdAt.Add(-time.Hour)
+
+	slo, err := buildsQueueSLO(tx, "remind101/acme-inc", since, 2*time.Minute, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, slo.Sampled)
+	assert.Equal(t, 3, slo.WithinTarget)
+	assert.Equal(t, 0.75, slo.Compliance)
+	assert.Equal(t, 268500*time.Millisecond, slo.P95)
+
+	slo, err = buildsQueueSLO(tx, "remind101/acme-inc", since, 2*time.Minute, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, slo.Sampled)
+	assert.Equal(t, 3, slo.WithinTarget)
+	assert.Equal(t, 0.6, slo.Compliance)
+
+	slo, err = buildsQueueSLO(tx, "remind101/other", since, 2*time.Minute, true)
+	assert.NoError(t, err)
+	assert.Equal(t, SLOResult{Compliance: 1}, slo)
+}
+
+func TestBuildsQueueSLO_UpdateState(t *testing.T) {
+	// Like circle.yml, run with the process in a zone other than UTC.
+	local := time.Local
+	time.Local = time.FixedZone("PDT", -7*60*60)
+	defer func() { time.Local = local }()
+
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+	tx.MustExec(tx.Rebind(`UPDATE builds SET created_at = ? WHERE id = ?`), time.Now().UTC().Add(-10*time.Minute), b.ID)
+	assert.NoError(t, buildsUpdateState(tx, b.ID, StateBuilding))
+
+	slo, err := buildsQueueSLO(tx, "remind101/acme-inc", time.Now().Add(-time.Hour), 2*time.Minute, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, slo.Sampled)
+	assert.Equal(t, 0, slo.WithinTarget)
+	assert.True(t, slo.P95 > 9*time.Minute && slo.P95 < 11*time.Minute, slo.P95.String())
+}
+
+func TestBuildsActiveBranches(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	builds := []struct {
+		branch  string
+		state   BuildState
+		created time.Duration
+	}{
+		{"master", StateSucceeded, 3 * time.Hour},
+		{"master", StateFailed, time.Hour},
+		{"feature", StateSucceeded, 2 * time.Hour},
+		{"stale", StateSucceeded, 48 * time.Hour},
+	}
+	for i, tt := range builds {
+		createdAt := now.Add(-tt.created)
+		completedAt := createdAt.Add(time.Minute)
+		assert.NoError(t, buildsImport(tx, &Build{
+			Repository:  "remind101/acme-inc",
+			Branch:      tt.branch,
+			Sha:         fmt.Sprintf("%040x", i),
+			State:       tt.state,
+			CreatedAt:   createdAt,
+			CompletedAt: &completedAt,
+		}))
+	}
+
+	branches, err := buildsActiveBranches(tx, "remind101/acme-inc", now.Add(-24*time.Hour))
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(branches)) {
+		assert.Equal(t, "master", branches[0].Branch)
+		assert.Equal(t, now.Add(-time.Hour), branches[0].LatestAt.UTC())
+		assert.Equal(t, StateFailed, branches[0].State)
+		assert.Equal(t, "feature", branches[1].Branch)
+		assert.Equal(t, now.Add(-2*time.Hour), branches[1].LatestAt.UTC())
+		assert.Equal(t, StateSucceeded, branches[1].State)
+	}
+}
+
+func TestBuildsMergeDuplicates(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	tx.MustExec(`DROP INDEX unique_build`)
+
+	var builds []*Build
+	for i := 0; i < 3; i++ {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		builds = append(builds, b)
+	}
+	keep, merged := builds[0], []string{builds[1].ID, builds[2].ID}
+
+	a := &BuildArtifact{
+		BuildID:     builds[1].ID,
+		Name:        "test.log",
+		URL:         "https://s3.amazonaws.com/conveyor/test.log",
+		ContentType: "text/plain",
+	}
+	assert.NoError(t, buildsAddArtifact(tx, a))
+
+	assert.EqualError(t, buildsMergeDuplicates(tx, keep.ID, []string{keep.ID}), "cannot merge a build into itself")
+
+	other := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	}
+	assert.NoError(t, buildsCreate(tx, other))
+	err := buildsMergeDuplicates(tx, keep.ID, []string{other.ID})
+	assert.EqualError(t, err, fmt.Sprintf("cannot merge build %s for remind101/acme-inc@%s into a build for remind101/acme-inc@%s", other.ID, other.Sha, keep.Sha))
+
+	assert.EqualError(t, buildsMergeDuplicates(tx, keep.ID, []string{fakeUUID}), "cannot merge builds that don't exist: "+fakeUUID)
+
+	// The kept build is a retry of one of the merged builds.
+	tx.MustExec(`UPDATE builds SET parent_build_id = $1 WHERE id = $2`, builds[1].ID, keep.ID)
+
+	assert.NoError(t, buildsMergeDuplicates(tx, keep.ID, append(merged, builds[1].ID)))
+
+	groups, err := buildsFindDuplicateActive(tx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(groups))
+
+	kept, err := buildsFindByID(tx, keep.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, kept.ParentBuildID)
+
+	artifacts, err := buildsArtifacts(tx, keep.ID)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(artifacts)) {
+		assert.Equal(t, a.ID, artifacts[0].ID)
+	}
+
+	found, missing, err := buildsFindByIDs(tx, merged)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(found))
+	assert.Equal(t, merged, missing)
+
+	assert.NoError(t, buildsUpdateState(tx, keep.ID, StateSucceeded))
+	assert.EqualError(t, buildsMergeDuplicates(tx, keep.ID, merged), "cannot merge builds into a succeeded build")
+}
+
+func TestBuildsCreateAndStart(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b, err := buildsCreateAndStart(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+
+	found, err := buildsFindByID(tx, b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StateBuilding, found.State)
+	assert.True(t, found.HasStarted())
+
+	_, err = buildsCreateAndStart(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.Equal(t, &DuplicateBuildError{ExistingBuildID: b.ID}, err)
+}
+
+func TestBuildsExportImportQueue(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	pending := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, pending))
+
+	building := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	}
+	assert.NoError(t, buildsCreate(tx, building))
+	assert.NoError(t, buildsUpdateState(tx, building.ID, StateBuilding))
+
+	done := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2",
+	}
+	assert.NoError(t, buildsCreate(tx, done))
+	assert.NoError(t, buildsUpdateState(tx, done.ID, StateSucceeded))
+
+	exported, err := buildsExportQueue(tx)
+	assert.NoError(t, err)
+	if !assert.Equal(t, 2, len(exported)) {
+		return
+	}
+
+	// Simulate restoring into a fresh database, where the building build was
+	// lost but a new build for the pending sha was already created.
+	tx.MustExec(tx.Rebind(`DELETE FROM builds WHERE id IN (?, ?)`), pending.ID, building.ID)
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}))
+
+	imported, err := buildsImportQueue(tx, exported)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(imported)) {
+		assert.Equal(t, building.ID, imported[0].ID)
+	}
+
+	b, err := buildsFindByID(tx, building.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatePending, b.State)
+	assert.False(t, b.HasStarted())
+	assert.Equal(t, exported[1].CreatedAt, b.CreatedAt)
+}
+
+func TestBuildsImportQueue_Retry(t *testing.T) {
+	c := newConveyor(t)
+
+	tx := c.db.MustBegin()
+	parent := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, parent))
+	assert.NoError(t, buildsFail(tx, parent.ID, FailureReasonInfra, ""))
+	retry, err := buildsRetry(tx, parent.ID)
+	assert.NoError(t, err)
+
+	exported, err := buildsExportQueue(tx)
+	assert.NoError(t, err)
+	tx.Rollback()
+
+	// The parent build isn't in the fresh database.
+	tx = c.db.MustBegin()
+	defer tx.Rollback()
+
+	imported, err := buildsImportQueue(tx, exported)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(imported)) {
+		assert.Equal(t, retry.ID, imported[0].ID)
+		assert.Nil(t, imported[0].ParentBuildID)
+		assert.Equal(t, 2, imported[0].Attempt)
+	}
+}
+
+func TestBuildsLongestRunning(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	builds := []struct {
+		repository, sha string
+		started         time.Duration
+	}{
+		{"remind101/acme-inc", "139759bd61e98faeec619c45b1060b4288952164", 10 * time.Minute},
+		{"remind101/acme-inc", "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f", 30 * time.Minute},
+		{"remind101/other", "2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2", time.Minute},
+	}
+	var ids []string
+	for _, tt := range builds {
+		b, err := buildsCreateAndStart(tx, &Build{
+			Repository: tt.repository,
+			Branch:     "master",
+			Sha:        tt.sha,
+		})
+		assert.NoError(t, err)
+		tx.MustExec(tx.Rebind(`UPDATE builds SET started_at = ? WHERE id = ?`), time.Now().UTC().Add(-tt.started), b.ID)
+		ids = append(ids, b.ID)
+	}
+
+	// Pending builds haven't started running.
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/pending",
+		Branch:     "master",
+		Sha:        "8d4a5a8e3e21d53b7f2f8a3b5c3e4d7e6f1a2b3c",
+	}))
+
+	longest, err := buildsLongestRunning(tx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(longest))
+	assert.Equal(t, ids[1], longest["remind101/acme-inc"].ID)
+	assert.Equal(t, ids[2], longest["remind101/other"].ID)
+
+	elapsed := longest["remind101/acme-inc"].Elapsed
+	assert.True(t, elapsed >= 29*time.Minute && elapsed <= 31*time.Minute, elapsed.String())
+}
+
+func TestBuildsSinceLastGreen(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	states := []BuildState{StateFailed, StateSucceeded, StateFailed, StateFailed}
+	var ids []string
+	for i, state := range states {
+		b := &Build{
+			Repository: "remind101/acme-inc",
+			Branch:     "master",
+			Sha:        fmt.Sprintf("%040x", i),
+		}
+		assert.NoError(t, buildsCreate(tx, b))
+		assert.NoError(t, buildsUpdateState(tx, b.ID, state))
+		ids = append(ids, b.ID)
+	}
+
+	pending := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        fmt.Sprintf("%040x", len(states)),
+	}
+	assert.NoError(t, buildsCreate(tx, pending))
+	ids = append(ids, pending.ID)
+
+	builds, err := buildsSinceLastGreen(tx, "remind101/acme-inc", "refs/heads/master")
+	assert.NoError(t, err)
+	var got []string
+	for _, b := range builds {
+		got = append(got, b.ID)
+	}
+	assert.Equal(t, ids[2:], got)
+
+	// Never been green.
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "feature",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}))
+	builds, err = buildsSinceLastGreen(tx, "remind101/acme-inc", "feature")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(builds))
+}
+
+func TestIsDuplicateBuild(t *testing.T) {
+	assert.True(t, IsDuplicateBuild(ErrDuplicateBuild))
+	assert.True(t, IsDuplicateBuild(&DuplicateBuildError{ExistingBuildID: fakeUUID}))
+	assert.False(t, IsDuplicateBuild(ErrInvalidTransition))
+	assert.False(t, IsDuplicateBuild(nil))
+}
+
+func TestNormalizeSha(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"139759BD61E98FAEEC619C45B1060B4288952164", "139759bd61e98faeec619c45b1060b4288952164"},
+		{"139759b", "139759b"},
+		{"rAbC", "rAbC"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.out, normalizeSha(tt.in), tt.in)
+	}
+}
+
+func TestNormalizeBranch(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		err error
+	}{
+		{"master", "master", nil},
+		{"refs/heads/master", "master", nil},
+		{"refs/tags/v1.0.0", "v1.0.0", nil},
+		{" refs/heads/feature/foo ", "feature/foo", nil},
+		{"heads/master", "heads/master", nil},
+		{"", "", nil},
+		{"   ", "", ErrInvalidBranch},
+		{"refs/heads/", "", ErrInvalidBranch},
+	}
+
+	for _, tt := range tests {
+		branch, err := normalizeBranch(tt.in)
+		assert.Equal(t, tt.err, err, tt.in)
+		assert.Equal(t, tt.out, branch, tt.in)
+	}
+}
+
+func TestBuildsCreate_NormalizesBranch(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	b := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "refs/heads/master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, b))
+	assert.Equal(t, "master", b.Branch)
+
+	found, err := buildsFindByID(tx, b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "master", found.Branch)
+
+	err = buildsCreate(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     " ",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	})
+	assert.Equal(t, ErrInvalidBranch, err)
+}
+
+func TestBuildsReposWithoutRecentSuccess(t *testing.T) {
+	// A build that just succeeded shouldn't look hours old when the
+	// process isn't in UTC.
+	local := time.Local
+	time.Local = time.FixedZone("PDT", -7*60*60)
+	defer func() { time.Local = local }()
+
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	green := &Build{
+		Repository: "remind101/green",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, green))
+	assert.NoError(t, buildsUpdateState(tx, green.ID, StateSucceeded))
+
+	red := &Build{
+		Repository: "remind101/red",
+		Branch:     "master",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	}
+	assert.NoError(t, buildsCreate(tx, red))
+	assert.NoError(t, buildsUpdateState(tx, red.ID, StateFailed))
+
+	// Succeeded, but not recently.
+	completedAt := time.Now().UTC().Add(-48 * time.Hour)
+	assert.NoError(t, buildsImport(tx, &Build{
+		Repository:  "remind101/stale",
+		Branch:      "master",
+		Sha:         "2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2",
+		State:       StateSucceeded,
+		CreatedAt:   completedAt.Add(-time.Minute),
+		CompletedAt: &completedAt,
+	}))
+
+	// Never completed at all.
+	assert.NoError(t, buildsCreate(tx, &Build{
+		Repository: "remind101/pending",
+		Branch:     "master",
+		Sha:        "5a3f1bd4f7d3c0d6e2c1b6a9f0e8d7c6b5a4f3e2",
+	}))
+
+	repos, err := buildsReposWithoutRecentSuccess(tx, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"remind101/pending", "remind101/red", "remind101/stale"}, repos)
+}
+
+func TestBuildsSupersede(t *testing.T) {
+	c := newConveyor(t)
+	tx := c.db.MustBegin()
+	defer tx.Rollback()
+
+	old, err := buildsCreateAndStart(tx, &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+
+	b, err := buildsSupersede(tx, "remind101/acme-inc", "master", "139759BD61E98FAEEC619C45B1060B4288952164", &Build{})
+	assert.NoError(t, err)
+	assert.NotEqual(t, old.ID, b.ID)
+	assert.Equal(t, StatePending, b.State)
+	assert.Equal(t, "139759bd61e98faeec619c45b1060b4288952164", b.Sha)
+
+	cancelled, err := buildsFindByID(tx, old.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StateFailed, cancelled.State)
+	assert.Equal(t, FailureReasonCancelled, cancelled.FailureReason)
+
+	// Nothing to cancel.
+	_, err = buildsSupersede(tx, "remind101/acme-inc", "master", "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f", &Build{})
+	assert.NoError(t, err)
+}
@@ -40,6 +40,9 @@ func newDB(c *cli.Context) *sqlx.DB {
 	if err := conveyor.MigrateUp(db); err != nil {
 		panic(err)
 	}
+	if err := conveyor.VerifySchema(db); err != nil {
+		panic(err)
+	}
 	return db
 }
 
@@ -1,7 +1,10 @@
 package conveyor
 
 import (
+	"database/sql"
+	"errors"
 	"io"
+	"path"
 	"strings"
 
 	"github.com/google/go-github/github"
@@ -16,6 +19,32 @@ import (
 // newID returns a new unique identifier.
 var newID = uuid.New
 
+// ErrBranchNotFound is returned when a build is requested for a branch that no
+// longer exists.
+var ErrBranchNotFound = errors.New("branch not found")
+
+// ErrBranchForbidden is returned when a build is requested for a branch that
+// matches one of the ForbiddenBranches patterns.
+var ErrBranchForbidden = errors.New("builds are not allowed for this branch")
+
+// BranchValidator is used to check that a branch exists before a build is
+// created for it.
+type BranchValidator interface {
+	BranchExists(ctx context.Context, repository, branch string) (bool, error)
+}
+
+// StateReconciler fetches the state of a build from an external CI system
+// that's the source of truth for it.
+type StateReconciler interface {
+	FetchState(ctx context.Context, b *Build) (BuildState, error)
+}
+
+// IDGenerator generates the ids of new builds. Build ids are stored as uuids,
+// so generated ids must be valid uuids.
+type IDGenerator interface {
+	NewID() string
+}
+
 // Conveyor provides the primary api for triggering builds.
 type Conveyor struct {
 	// Hook is the webhook configuration for Conveyor.
@@ -29,6 +58,46 @@ type Conveyor struct {
 
 	GitHub GitHubAPI
 
+	// BranchValidator, if provided, is consulted before a build is created
+	// for a branch. If the branch no longer exists, ErrBranchNotFound is
+	// returned. The zero value skips the check.
+	BranchValidator BranchValidator
+
+	// ForbiddenBranches are patterns for branches that should never be
+	// built, like "gh-pages" or "backup/*". Patterns use path.Match syntax,
+	// so "*" doesn't match "/", and are case sensitive. Builds for matching
+	// branches return ErrBranchForbidden.
+	ForbiddenBranches []string
+
+	// MatchShaPrefix enables treating abbreviated shas as equivalent to
+	// the full sha that they're a prefix of. When enabled, finding a build
+	// by an abbreviated sha returns the most recent build whose sha starts
+	// with it, and a build won't be created if there's already an active
+	// build for a sha that's a prefix of it (or vice versa). The unique_build
+	// index can't enforce prefixes, so builds for the repository are created
+	// one at a time while this is enabled.
+	//
+	// Be careful with very short prefixes. The shorter the prefix, the more
+	// likely it is to match unrelated commits.
+	MatchShaPrefix bool
+
+	// IDGenerator, if provided, is used to generate the ids of new builds
+	// before they're inserted, like when ids should be sortable by creation
+	// time. The zero value lets the database generate ids.
+	IDGenerator IDGenerator
+
+	// ShaValidator, if provided, replaces the check that's done on the sha
+	// of new builds, like for repositories that use SHA-256 object names or
+	// synthetic revision ids. The default only allows hexadecimal shas.
+	// Hexadecimal shas are always stored in lowercase, but anything else
+	// the validator accepts is stored as is, since it may be case
+	// sensitive.
+	ShaValidator func(sha string) error
+
+	// StateReconciler is used by ReconcileBuild to fetch the state of
+	// builds that are run by an external CI system.
+	StateReconciler StateReconciler
+
 	db *sqlx.DB
 }
 
@@ -49,10 +118,42 @@ type BuildRequest struct {
 	// Set to true to disable the layer cache. The zero value is to enable
 	// caching.
 	NoCache bool
+	// IdempotencyKey optionally identifies this request. If a build was
+	// already created with the same key, that build is returned instead of
+	// creating a new one.
+	IdempotencyKey string
 }
 
 // Build enqueues a build to run.
 func (c *Conveyor) Build(ctx context.Context, req BuildRequest) (*Build, error) {
+	// Normalize the branch up front, so that refs/heads/gh-pages is
+	// checked the same way as gh-pages.
+	branch, err := normalizeBranch(req.Branch)
+	if err != nil {
+		return nil, err
+	}
+	req.Branch = branch
+
+	for _, pattern := range c.ForbiddenBranches {
+		forbidden, err := path.Match(pattern, req.Branch)
+		if err != nil {
+			return nil, err
+		}
+		if forbidden {
+			return nil, ErrBranchForbidden
+		}
+	}
+
+	if c.BranchValidator != nil && req.Branch != "" {
+		ok, err := c.BranchValidator.BranchExists(ctx, req.Repository, req.Branch)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrBranchNotFound
+		}
+	}
+
 	// A branch is provied with no sha. Use the GitHub API to resolve the
 	// branch to the sha of HEAD of the branch.
 	if req.Sha == "" && req.Branch != "" {
@@ -64,6 +165,15 @@ func (c *Conveyor) Build(ctx context.Context, req BuildRequest) (*Build, error)
 		req.Sha = sha
 	}
 
+	validate := validateSha
+	if c.ShaValidator != nil {
+		validate = c.ShaValidator
+	}
+
+	if err := validate(req.Sha); err != nil {
+		return nil, err
+	}
+
 	tx, err := c.db.Beginx()
 	if err != nil {
 		return nil, err
@@ -75,7 +185,48 @@ func (c *Conveyor) Build(ctx context.Context, req BuildRequest) (*Build, error)
 		Branch:     req.Branch,
 	}
 
-	if err := buildsCreate(tx, b); err != nil {
+	if c.IDGenerator != nil {
+		b.ID = c.IDGenerator.NewID()
+	}
+
+	if req.IdempotencyKey != "" {
+		b.IdempotencyKey = &req.IdempotencyKey
+	}
+
+	if c.MatchShaPrefix {
+		// Hold the lock until commit, so that a concurrent request for
+		// the full sha can't pass the check before this build exists.
+		if err := buildsLockRepository(tx, b.Repository); err != nil {
+			tx.Rollback()
+			return b, err
+		}
+
+		// A retried request gets the build it already created, rather
+		// than conflicting with it below.
+		if b.IdempotencyKey != nil {
+			existing, err := buildsFindByIdempotencyKey(tx, *b.IdempotencyKey)
+			if err != sql.ErrNoRows {
+				tx.Rollback()
+				if err != nil {
+					return b, err
+				}
+				return existing, nil
+			}
+		}
+
+		existingID, err := buildsActiveShaPrefixMatch(tx, b.Repository, b.Sha)
+		if err != nil {
+			tx.Rollback()
+			return b, err
+		}
+		if existingID != "" {
+			tx.Rollback()
+			return b, &DuplicateBuildError{ExistingBuildID: existingID}
+		}
+	}
+
+	created, err := buildsCreateIdempotent(tx, b)
+	if err != nil {
 		tx.Rollback()
 		return b, err
 	}
@@ -87,16 +238,111 @@ func (c *Conveyor) Build(ctx context.Context, req BuildRequest) (*Build, error)
 		return b, err
 	}
 
+	// This request was already handled, so the build is already queued.
+	if !created {
+		return b, nil
+	}
+
 	return b, c.BuildQueue.Push(ctx, builder.BuildOptions{
 		ID:         b.ID,
 		Repository: req.Repository,
-		Sha:        req.Sha,
-		Branch:     req.Branch,
+		Sha:        b.Sha,
+		Branch:     b.Branch,
 		NoCache:    req.NoCache,
 	})
 
 }
 
+// maxDedupAttempts bounds how many times BuildDedup will retry when the
+// conflicting build can't be found.
+const maxDedupAttempts = 3
+
+// BuildDedup is like Build, but if the sha already has a pending or building
+// build, that build is returned instead of an ErrDuplicateBuild. This gives
+// concurrent requests for the same sha a consistent *Build.
+func (c *Conveyor) BuildDedup(ctx context.Context, req BuildRequest) (*Build, error) {
+	var err error
+	for i := 0; i < maxDedupAttempts; i++ {
+		var b *Build
+		b, err = c.Build(ctx, req)
+		dup, ok := err.(*DuplicateBuildError)
+		if !ok {
+			// The conflicting build completed before it could be
+			// found, so try again.
+			if err == ErrDuplicateBuild {
+				continue
+			}
+			return b, err
+		}
+
+		b, err = c.FindBuild(ctx, dup.ExistingBuildID)
+		if err != sql.ErrNoRows {
+			return b, err
+		}
+	}
+
+	return nil, err
+}
+
+// RetryBuild creates a new build that retries a failed build, and pushes it onto
+// the BuildQueue.
+func (c *Conveyor) RetryBuild(ctx context.Context, buildID string) (*Build, error) {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := buildsRetry(tx, buildID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return b, err
+	}
+
+	return b, c.BuildQueue.Push(ctx, builder.BuildOptions{
+		ID:         b.ID,
+		Repository: b.Repository,
+		Sha:        b.Sha,
+		Branch:     b.Branch,
+	})
+}
+
+// SupersedeBuild cancels the active build for the requested sha, if there is
+// one, and pushes a new build for it onto the BuildQueue, like when a user asks
+// to rebuild a commit now.
+func (c *Conveyor) SupersedeBuild(ctx context.Context, req BuildRequest) (*Build, error) {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Build{}
+	if c.IDGenerator != nil {
+		b.ID = c.IDGenerator.NewID()
+	}
+
+	b, err = buildsSupersede(tx, req.Repository, req.Branch, req.Sha, b)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return b, err
+	}
+
+	return b, c.BuildQueue.Push(ctx, builder.BuildOptions{
+		ID:         b.ID,
+		Repository: b.Repository,
+		Sha:        b.Sha,
+		Branch:     b.Branch,
+		NoCache:    req.NoCache,
+	})
+}
+
 // FindBuild finds a build by its identity.
 func (c *Conveyor) FindBuild(ctx context.Context, buildIdentity string) (*Build, error) {
 	tx, err := c.db.Beginx()
@@ -108,6 +354,9 @@ func (c *Conveyor) FindBuild(ctx context.Context, buildIdentity string) (*Build,
 	switch strings.Contains(buildIdentity, "@") {
 	case true:
 		find = buildsFindByRepoSha
+		if c.MatchShaPrefix {
+			find = buildsFindByRepoShaPrefix
+		}
 	default:
 		find = buildsFindByID
 	}
@@ -155,14 +404,68 @@ func (c *Conveyor) Logs(ctx context.Context, buildID string) (io.Reader, error)
 	return c.Logger.Open(buildID)
 }
 
-// BuildStarted marks the build as started.
+// BuildStarted marks the build as started. If the build has already completed,
+// like when it was cancelled before a worker got to it, ErrInvalidTransition is
+// returned.
 func (c *Conveyor) BuildStarted(ctx context.Context, buildID string) error {
 	tx, err := c.db.Beginx()
 	if err != nil {
 		return err
 	}
 
-	if err := buildsUpdateState(tx, buildID, StateBuilding); err != nil {
+	if _, err := buildsStart(tx, buildID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// StartBuild marks a pending build as started, returning true if this call
+// started it. If another caller already started the build, false is returned
+// with no error, and if the build has completed, ErrInvalidTransition is
+// returned.
+func (c *Conveyor) StartBuild(ctx context.Context, buildID string) (bool, error) {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+
+	started, err := buildsStart(tx, buildID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return started, tx.Commit()
+}
+
+// ReconcileBuild brings the state of a build in line with the state reported by
+// the StateReconciler, like when the completion of a build was missed. Builds
+// are only ever moved forward; if the reported state would require moving the
+// build backwards, or changing a completed build, the discrepancy is logged and
+// the build is left alone.
+func (c *Conveyor) ReconcileBuild(ctx context.Context, buildID string) error {
+	if c.StateReconciler == nil {
+		return errors.New("conveyor: no StateReconciler configured")
+	}
+
+	b, err := c.FindBuild(ctx, buildID)
+	if err != nil {
+		return err
+	}
+
+	state, err := c.StateReconciler.FetchState(ctx, b)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if err := buildsReconcile(tx, buildID, state); err != nil {
 		tx.Rollback()
 		return err
 	}
@@ -171,13 +474,18 @@ func (c *Conveyor) BuildStarted(ctx context.Context, buildID string) error {
 }
 
 // BuildComplete marks a build as successful and adds the image as an artifact.
+// If the build already completed, like when it was cancelled while it was
+// building, it's left alone and no artifact is added.
 func (c *Conveyor) BuildComplete(ctx context.Context, buildID, image string) error {
 	tx, err := c.db.Beginx()
 	if err != nil {
 		return err
 	}
 
-	if err := buildsUpdateState(tx, buildID, StateSucceeded); err != nil {
+	if _, err := buildsCompleteReturning(tx, buildID, `state = ?`, StateSucceeded); err != nil {
+		if err == sql.ErrNoRows {
+			_, err = buildsFindByID(tx, buildID)
+		}
 		tx.Rollback()
 		return err
 	}
@@ -194,13 +502,18 @@ func (c *Conveyor) BuildComplete(ctx context.Context, buildID, image string) err
 }
 
 // BuildFailed marks the build as failed.
-func (c *Conveyor) BuildFailed(ctx context.Context, buildID string, err error) error {
+func (c *Conveyor) BuildFailed(ctx context.Context, buildID string, buildErr error) error {
+	reason, message := failureReason(buildErr), ""
+	if buildErr != nil {
+		message = buildErr.Error()
+	}
+
 	tx, err := c.db.Beginx()
 	if err != nil {
 		return err
 	}
 
-	if err := buildsUpdateState(tx, buildID, StateFailed); err != nil {
+	if err := buildsFail(tx, buildID, reason, message); err != nil {
 		tx.Rollback()
 		return err
 	}
@@ -208,6 +521,21 @@ func (c *Conveyor) BuildFailed(ctx context.Context, buildID string, err error) e
 	return tx.Commit()
 }
 
+// failureReason classifies a build error as a FailureReason. Errors that we
+// can't classify don't get a reason.
+func failureReason(err error) FailureReason {
+	if err, ok := err.(*builder.BuildCanceledError); ok {
+		switch err.Reason {
+		case context.DeadlineExceeded:
+			return FailureReasonTimeout
+		case context.Canceled:
+			return FailureReasonCancelled
+		}
+	}
+
+	return ""
+}
+
 // EnableRepo installs the webhook on the repo.
 func (c *Conveyor) EnableRepo(ctx context.Context, fullRepo string) error {
 	owner, repo := splitRepo(fullRepo)
@@ -220,12 +548,8 @@ func insert(tx *sqlx.Tx, sql string, v interface{}, returns ...interface{}) erro
 		return err
 	}
 	defer rows.Close()
-	if rows.Next() {
-		for _, r := range returns {
-			rows.Scan(r)
-		}
-	} else {
+	if !rows.Next() {
 		panic("expected id to be returned")
 	}
-	return nil
+	return rows.Scan(returns...)
 }
@@ -1,7 +1,9 @@
 package conveyor
 
 import (
+	"database/sql"
 	"errors"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -76,7 +78,8 @@ func TestConveyor_Build_Duplicate(t *testing.T) {
 		Branch:     "master",
 		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
 	})
-	assert.Equal(t, ErrDuplicateBuild, err)
+	assert.True(t, IsDuplicateBuild(err))
+	assert.Equal(t, &DuplicateBuildError{ExistingBuildID: b.ID}, err)
 
 	err = c.BuildStarted(context.Background(), b.ID)
 	assert.NoError(t, err)
@@ -86,7 +89,358 @@ func TestConveyor_Build_Duplicate(t *testing.T) {
 		Branch:     "master",
 		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
 	})
-	assert.Equal(t, ErrDuplicateBuild, err)
+	assert.True(t, IsDuplicateBuild(err))
+	assert.Equal(t, &DuplicateBuildError{ExistingBuildID: b.ID}, err)
+}
+
+func TestConveyor_BuildDedup(t *testing.T) {
+	c := newConveyor(t)
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+
+	dup, err := c.BuildDedup(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, dup.ID)
+}
+
+func TestConveyor_RetryBuild(t *testing.T) {
+	q := new(mockBuildQueue)
+	c := newConveyor(t)
+	c.BuildQueue = q
+
+	tx := c.db.MustBegin()
+	failed := &Build{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	assert.NoError(t, buildsCreate(tx, failed))
+	assert.NoError(t, buildsFail(tx, failed.ID, FailureReasonInfra, ""))
+	assert.NoError(t, tx.Commit())
+
+	q.On("Push", builder.BuildOptions{
+		ID:         "<build_id>",
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}).Return(nil)
+
+	b, err := c.RetryBuild(context.Background(), failed.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, failed.ID, *b.ParentBuildID)
+
+	q.AssertExpectations(t)
+}
+
+func TestConveyor_SupersedeBuild(t *testing.T) {
+	q := new(mockBuildQueue)
+	c := newConveyor(t)
+	c.BuildQueue = q
+
+	q.On("Push", builder.BuildOptions{
+		ID:         "<build_id>",
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}).Twice().Return(nil)
+
+	req := BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}
+	old, err := c.Build(context.Background(), req)
+	assert.NoError(t, err)
+
+	b, err := c.SupersedeBuild(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, old.ID, b.ID)
+
+	old, err = c.FindBuild(context.Background(), old.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, FailureReasonCancelled, old.FailureReason)
+
+	q.AssertExpectations(t)
+}
+
+func TestConveyor_Build_IDGenerator(t *testing.T) {
+	c := newConveyor(t)
+	c.IDGenerator = staticIDGenerator(fakeUUID)
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, fakeUUID, b.ID)
+
+	found, err := c.FindBuild(context.Background(), fakeUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "139759bd61e98faeec619c45b1060b4288952164", found.Sha)
+
+	// A colliding id isn't reported as a duplicate build.
+	_, err = c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	})
+	assert.Equal(t, ErrDuplicateID, err)
+}
+
+func TestConveyor_Build_IdempotencyKey(t *testing.T) {
+	q := new(mockBuildQueue)
+	c := newConveyor(t)
+	c.BuildQueue = q
+
+	q.On("Push", builder.BuildOptions{
+		ID:         "<build_id>",
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}).Once().Return(nil)
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository:     "remind101/acme-inc",
+		Branch:         "master",
+		Sha:            "139759bd61e98faeec619c45b1060b4288952164",
+		IdempotencyKey: "abcd",
+	})
+	assert.NoError(t, err)
+
+	// Retrying with the same key returns the original build without
+	// queueing it again.
+	retried, err := c.Build(context.Background(), BuildRequest{
+		Repository:     "remind101/acme-inc",
+		Branch:         "master",
+		Sha:            "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+		IdempotencyKey: "abcd",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, retried.ID)
+	assert.Equal(t, "139759bd61e98faeec619c45b1060b4288952164", retried.Sha)
+
+	q.AssertExpectations(t)
+}
+
+func TestConveyor_Build_UppercaseSha(t *testing.T) {
+	c := newConveyor(t)
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759BD61E98FAEEC619C45B1060B4288952164",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "139759bd61e98faeec619c45b1060b4288952164", b.Sha)
+
+	_, err = c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.Equal(t, &DuplicateBuildError{ExistingBuildID: b.ID}, err)
+
+	found, err := c.FindBuild(context.Background(), "remind101/acme-inc@139759BD61E98FAEEC619C45B1060B4288952164")
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, found.ID)
+
+	_, err = c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "not-a-sha",
+	})
+	assert.Equal(t, ErrInvalidSha, err)
+}
+
+func TestConveyor_Build_ShaValidator(t *testing.T) {
+	c := newConveyor(t)
+	c.ShaValidator = func(sha string) error {
+		if !strings.HasPrefix(sha, "r") {
+			return ErrInvalidSha
+		}
+		return nil
+	}
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "r1234",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "r1234", b.Sha)
+
+	// Revision ids that aren't hex keep their case.
+	b, err = c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "rAbC",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "rAbC", b.Sha)
+
+	found, err := c.FindBuild(context.Background(), "remind101/acme-inc@rAbC")
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, found.ID)
+
+	_, err = c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.Equal(t, ErrInvalidSha, err)
+}
+
+func TestConveyor_Build_BranchNotFound(t *testing.T) {
+	v := new(mockBranchValidator)
+	c := newConveyor(t)
+	c.BranchValidator = v
+
+	v.On("BranchExists", "remind101/acme-inc", "deleted").Return(false, nil)
+
+	_, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "deleted",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.Equal(t, ErrBranchNotFound, err)
+
+	v.AssertExpectations(t)
+}
+
+func TestConveyor_Build_ForbiddenBranches(t *testing.T) {
+	c := newConveyor(t)
+	c.ForbiddenBranches = []string{"gh-pages", "backup/*"}
+
+	for _, branch := range []string{"gh-pages", "backup/2015-01-01", "refs/heads/gh-pages"} {
+		_, err := c.Build(context.Background(), BuildRequest{
+			Repository: "remind101/acme-inc",
+			Branch:     branch,
+			Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+		})
+		assert.Equal(t, ErrBranchForbidden, err)
+	}
+
+	_, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "GH-PAGES",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+}
+
+func TestConveyor_Build_NormalizesBranch(t *testing.T) {
+	q := new(mockBuildQueue)
+	c := newConveyor(t)
+	c.BuildQueue = q
+
+	q.On("Push", builder.BuildOptions{
+		ID:         "<build_id>",
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}).Return(nil)
+	q.On("Push", builder.BuildOptions{
+		ID:         "<build_id>",
+		Repository: "remind101/acme-inc",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	}).Return(nil)
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "refs/heads/master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "master", b.Branch)
+
+	// Builds can still be requested for just a sha.
+	_, err = c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Sha:        "c1e0f0aa0e1f5d2c0c0f04a8c81c5e13c89d0a8f",
+	})
+	assert.NoError(t, err)
+
+	_, err = c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "refs/heads/",
+		Sha:        "2a9c39be2f1f2c6e1b4a69b8e8b7cbf44d7ad0a2",
+	})
+	assert.Equal(t, ErrInvalidBranch, err)
+
+	q.AssertExpectations(t)
+}
+
+func TestConveyor_Build_MatchShaPrefix(t *testing.T) {
+	c := newConveyor(t)
+	c.MatchShaPrefix = true
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759b",
+	})
+	assert.NoError(t, err)
+
+	_, err = c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	if dup, ok := err.(*DuplicateBuildError); assert.True(t, ok) {
+		assert.Equal(t, b.ID, dup.ExistingBuildID)
+	}
+
+	found, err := c.FindBuild(context.Background(), "remind101/acme-inc@139759")
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, found.ID)
+}
+
+func TestConveyor_Build_MatchShaPrefix_IdempotencyKey(t *testing.T) {
+	c := newConveyor(t)
+	c.MatchShaPrefix = true
+
+	req := BuildRequest{
+		Repository:     "remind101/acme-inc",
+		Branch:         "master",
+		Sha:            "139759b",
+		IdempotencyKey: "abcd",
+	}
+	b, err := c.Build(context.Background(), req)
+	assert.NoError(t, err)
+
+	retried, err := c.Build(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, retried.ID)
+}
+
+func TestConveyor_BuildDedup_MatchShaPrefix(t *testing.T) {
+	c := newConveyor(t)
+	c.MatchShaPrefix = true
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759b",
+	})
+	assert.NoError(t, err)
+
+	dup, err := c.BuildDedup(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, dup.ID)
 }
 
 func TestConveyor_BuildStarted(t *testing.T) {
@@ -109,6 +463,63 @@ func TestConveyor_BuildStarted(t *testing.T) {
 	assert.Equal(t, StateBuilding, b.State)
 }
 
+func TestConveyor_StartBuild(t *testing.T) {
+	c := newConveyor(t)
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+
+	started, err := c.StartBuild(context.Background(), b.ID)
+	assert.NoError(t, err)
+	assert.True(t, started)
+
+	// Another worker already started it.
+	started, err = c.StartBuild(context.Background(), b.ID)
+	assert.NoError(t, err)
+	assert.False(t, started)
+
+	err = c.BuildComplete(context.Background(), b.ID, "remind101/acme-inc:139759bd61e98faeec619c45b1060b4288952164")
+	assert.NoError(t, err)
+
+	_, err = c.StartBuild(context.Background(), b.ID)
+	assert.Equal(t, ErrInvalidTransition, err)
+}
+
+func TestConveyor_ReconcileBuild(t *testing.T) {
+	r := new(mockStateReconciler)
+	c := newConveyor(t)
+	c.StateReconciler = r
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+
+	// The completion was missed.
+	r.On("FetchState", b.ID).Return(StateSucceeded, nil).Once()
+	assert.NoError(t, c.ReconcileBuild(context.Background(), b.ID))
+
+	b, err = c.FindBuild(context.Background(), b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StateSucceeded, b.State)
+
+	// Completed builds are never changed.
+	r.On("FetchState", b.ID).Return(StateFailed, nil).Once()
+	assert.NoError(t, c.ReconcileBuild(context.Background(), b.ID))
+
+	b, err = c.FindBuild(context.Background(), b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StateSucceeded, b.State)
+
+	r.AssertExpectations(t)
+}
+
 func TestConveyor_BuildComplete(t *testing.T) {
 	c := newConveyor(t)
 
@@ -130,6 +541,34 @@ func TestConveyor_BuildComplete(t *testing.T) {
 	assert.Equal(t, StateSucceeded, b.State)
 }
 
+func TestConveyor_BuildComplete_Cancelled(t *testing.T) {
+	c := newConveyor(t)
+
+	b, err := c.Build(context.Background(), BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "master",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	})
+	assert.NoError(t, err)
+
+	tx := c.db.MustBegin()
+	assert.NoError(t, buildsFail(tx, b.ID, FailureReasonCancelled, ""))
+	assert.NoError(t, tx.Commit())
+
+	image := "remind101/acme-inc:139759bd61e98faeec619c45b1060b4288952164"
+	err = c.BuildComplete(context.Background(), b.ID, image)
+	assert.NoError(t, err)
+
+	b, err = c.FindBuild(context.Background(), b.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StateFailed, b.State)
+
+	_, err = c.FindArtifact(context.Background(), "remind101/acme-inc@139759bd61e98faeec619c45b1060b4288952164")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.Equal(t, sql.ErrNoRows, c.BuildComplete(context.Background(), fakeUUID, image))
+}
+
 func TestConveyor_BuildFailed(t *testing.T) {
 	c := newConveyor(t)
 
@@ -148,6 +587,22 @@ func TestConveyor_BuildFailed(t *testing.T) {
 	assert.NotNil(t, b)
 	assert.NotNil(t, b.CompletedAt)
 	assert.Equal(t, StateFailed, b.State)
+	assert.Equal(t, "Docker error", *b.Error)
+}
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason FailureReason
+	}{
+		{errors.New("boom"), ""},
+		{&builder.BuildCanceledError{Err: errors.New("exit 1"), Reason: context.DeadlineExceeded}, FailureReasonTimeout},
+		{&builder.BuildCanceledError{Err: errors.New("exit 1"), Reason: context.Canceled}, FailureReasonCancelled},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.reason, failureReason(tt.err))
+	}
 }
 
 func TestConveyor_FindArtifact(t *testing.T) {
@@ -266,3 +721,27 @@ func (m *mockBuildQueue) Push(ctx context.Context, options builder.BuildOptions)
 func (m *mockBuildQueue) Subscribe(chan BuildContext) error {
 	return nil
 }
+
+type mockBranchValidator struct {
+	mock.Mock
+}
+
+func (m *mockBranchValidator) BranchExists(ctx context.Context, repository, branch string) (bool, error) {
+	args := m.Called(repository, branch)
+	return args.Bool(0), args.Error(1)
+}
+
+type staticIDGenerator string
+
+func (g staticIDGenerator) NewID() string {
+	return string(g)
+}
+
+type mockStateReconciler struct {
+	mock.Mock
+}
+
+func (m *mockStateReconciler) FetchState(ctx context.Context, b *Build) (BuildState, error) {
+	args := m.Called(b.ID)
+	return args.Get(0).(BuildState), args.Error(1)
+}
@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE builds ADD COLUMN failure_reason text;
+ALTER TABLE builds ADD COLUMN error text;
+
+-- +migrate Down
+ALTER TABLE builds DROP COLUMN error;
+ALTER TABLE builds DROP COLUMN failure_reason;
@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE builds ADD COLUMN idempotency_key text;
+
+-- Builds created with the same idempotency key are the same logical build.
+CREATE UNIQUE INDEX unique_idempotency_key ON builds USING btree (idempotency_key);
+
+-- +migrate Down
+DROP INDEX unique_idempotency_key;
+ALTER TABLE builds DROP COLUMN idempotency_key;
@@ -0,0 +1,22 @@
+-- +migrate Up
+-- Shas are now always stored in lowercase. Active builds are left alone if
+-- lowercasing them would collide with another active build for the same sha,
+-- since that would violate unique_build.
+UPDATE builds SET sha = lower(sha)
+WHERE sha <> lower(sha)
+AND NOT (
+  state IN ('pending', 'building')
+  AND EXISTS (
+    SELECT 1 FROM builds AS other
+    WHERE other.id <> builds.id
+    AND lower(other.sha) = lower(builds.sha)
+    AND other.state IN ('pending', 'building')
+  )
+);
+
+UPDATE artifacts SET sha = builds.sha
+FROM builds
+WHERE artifacts.build_id = builds.id
+AND artifacts.sha <> builds.sha;
+
+-- +migrate Down
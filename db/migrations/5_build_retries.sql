@@ -0,0 +1,9 @@
+-- +migrate Up
+-- Retried builds are linked to the build they retried, and count up from the
+-- first attempt.
+ALTER TABLE builds ADD COLUMN parent_build_id uuid references builds(id);
+ALTER TABLE builds ADD COLUMN attempt integer NOT NULL DEFAULT 1;
+
+-- +migrate Down
+ALTER TABLE builds DROP COLUMN attempt;
+ALTER TABLE builds DROP COLUMN parent_build_id;
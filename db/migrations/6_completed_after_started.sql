@@ -0,0 +1,8 @@
+-- +migrate Up
+-- Clock skew between workers has produced builds that completed before they
+-- started. Clamp those before adding the check.
+UPDATE builds SET completed_at = started_at WHERE completed_at < started_at;
+ALTER TABLE builds ADD CONSTRAINT completed_after_started CHECK (completed_at >= started_at);
+
+-- +migrate Down
+ALTER TABLE builds DROP CONSTRAINT completed_after_started;
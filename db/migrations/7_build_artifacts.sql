@@ -0,0 +1,18 @@
+-- +migrate Up
+-- Files that a build produced, like binaries or logs, that can be downloaded
+-- from the build.
+CREATE TABLE build_artifacts (
+  id uuid NOT NULL DEFAULT uuid_generate_v4() primary key,
+  seq SERIAL,
+  build_id uuid NOT NULL references builds(id),
+  name text NOT NULL,
+  url text NOT NULL,
+  size_bytes bigint NOT NULL,
+  content_type text NOT NULL,
+  created_at timestamp without time zone default (now() at time zone 'utc') NOT NULL
+);
+
+CREATE INDEX index_build_artifacts_on_build_id ON build_artifacts USING btree (build_id);
+
+-- +migrate Down
+DROP TABLE build_artifacts;
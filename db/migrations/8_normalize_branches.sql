@@ -0,0 +1,10 @@
+-- +migrate Up
+-- Branches are now stored without their ref prefix, so that builds created
+-- from "refs/heads/master" and "master" are on the same branch.
+UPDATE builds SET branch = btrim(branch) WHERE branch <> btrim(branch);
+UPDATE builds SET branch = substring(branch from length('refs/heads/') + 1)
+WHERE branch LIKE 'refs/heads/%';
+UPDATE builds SET branch = substring(branch from length('refs/tags/') + 1)
+WHERE branch LIKE 'refs/tags/%';
+
+-- +migrate Down
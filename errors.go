@@ -0,0 +1,62 @@
+package conveyor
+
+import (
+	"database/sql/driver"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// Postgres error codes that mean the connection to the database was lost or
+// couldn't be made. See
+// http://www.postgresql.org/docs/current/static/errcodes-appendix.html
+const (
+	pqClassConnectionException = pq.ErrorClass("08")
+	pqAdminShutdown            = pq.ErrorCode("57P01")
+	pqCrashShutdown            = pq.ErrorCode("57P02")
+	pqCannotConnectNow         = pq.ErrorCode("57P03")
+	pqTooManyConnections       = pq.ErrorCode("53300")
+)
+
+// Postgres error codes that mean the transaction was aborted because of a
+// conflict with a concurrent transaction, and can be retried.
+const (
+	pqSerializationFailure = pq.ErrorCode("40001")
+	pqDeadlockDetected     = pq.ErrorCode("40P01")
+)
+
+// IsConnectionError returns true if err means that conveyor couldn't talk to
+// the database, like when it's down, restarting, or out of connections.
+func IsConnectionError(err error) bool {
+	switch err := err.(type) {
+	case *pq.Error:
+		switch err.Code {
+		case pqAdminShutdown, pqCrashShutdown, pqCannotConnectNow, pqTooManyConnections:
+			return true
+		}
+		return err.Code.Class() == pqClassConnectionException
+	case *net.OpError:
+		return true
+	}
+
+	return err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// IsTransient returns true if the operation that returned err can be retried
+// and might succeed, either because the database was unavailable or because the
+// transaction conflicted with another one.
+func IsTransient(err error) bool {
+	if IsConnectionError(err) {
+		return true
+	}
+
+	if err, ok := err.(*pq.Error); ok {
+		switch err.Code {
+		case pqSerializationFailure, pqDeadlockDetected:
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,44 @@
+package conveyor
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err        error
+		connection bool
+		transient  bool
+	}{
+		{&pq.Error{Code: "57P01"}, true, true},
+		{&pq.Error{Code: "57P03"}, true, true},
+		{&pq.Error{Code: "53300"}, true, true},
+		{&pq.Error{Code: "08006"}, true, true},
+		{&pq.Error{Code: "08001"}, true, true},
+		{&pq.Error{Code: "40001"}, false, true},
+		{&pq.Error{Code: "40P01"}, false, true},
+		{&pq.Error{Code: "23505"}, false, false},
+		{&pq.Error{Code: "42P01"}, false, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true, true},
+		{driver.ErrBadConn, true, true},
+		{io.EOF, true, true},
+		{sql.ErrNoRows, false, false},
+		{ErrDuplicateBuild, false, false},
+		{errors.New("boom"), false, false},
+		{nil, false, false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.connection, IsConnectionError(tt.err), "IsConnectionError(%v)", tt.err)
+		assert.Equal(t, tt.transient, IsTransient(tt.err), "IsTransient(%v)", tt.err)
+	}
+}
@@ -1,8 +1,12 @@
 package conveyor
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/rubenv/sql-migrate"
+	"golang.org/x/net/context"
 )
 
 var Migrations = &migrate.AssetMigrationSource{
@@ -33,3 +37,113 @@ func Reset(db *sqlx.DB) error {
 
 	return MigrateUp(db)
 }
+
+// requiredIndexes are the indexes that conveyor relies on to behave correctly.
+// If unique_build is missing, duplicate builds are no longer detected.
+var requiredIndexes = []string{
+	uniqueBuildConstraint,
+	"unique_idempotency_key",
+}
+
+// VerifySchema checks that the indexes that conveyor relies on exist,
+// returning an error that lists any that are missing. It's cheap enough to run
+// on boot.
+func VerifySchema(db *sqlx.DB) error {
+	sql, args, err := sqlx.In(`SELECT indexname FROM pg_indexes WHERE tablename = 'builds' AND indexname IN (?)`, requiredIndexes)
+	if err != nil {
+		return err
+	}
+
+	var indexes []string
+	if err := db.Select(&indexes, db.Rebind(sql), args...); err != nil {
+		return err
+	}
+
+	exists := make(map[string]bool)
+	for _, index := range indexes {
+		exists[index] = true
+	}
+
+	var missing []string
+	for _, index := range requiredIndexes {
+		if !exists[index] {
+			missing = append(missing, index)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("schema is missing required indexes: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// SchemaInfo describes the schema of the database that conveyor is connected
+// to.
+type SchemaInfo struct {
+	// The id of the most recently applied migration, like
+	// "7_build_artifacts.sql".
+	Version string
+	// Migrations that this version of conveyor knows about, but that
+	// haven't been applied.
+	Pending []string
+	// The optional features that the schema supports, keyed by name.
+	Features map[string]bool
+}
+
+// schemaFeatures maps optional features to the table and column (if any) that
+// they need.
+var schemaFeatures = map[string][2]string{
+	"failure_reasons":  {"builds", "failure_reason"},
+	"idempotency_keys": {"builds", "idempotency_key"},
+	"retries":          {"builds", "parent_build_id"},
+	"build_artifacts":  {"build_artifacts", ""},
+}
+
+// SchemaInfo returns the applied schema version and which optional features the
+// schema supports, like to verify that a deploy has been migrated.
+func (c *Conveyor) SchemaInfo(ctx context.Context) (*SchemaInfo, error) {
+	records, err := migrate.GetMigrationRecords(c.db.DB, c.db.DriverName())
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := Migrations.FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &SchemaInfo{Features: make(map[string]bool)}
+
+	applied := make(map[string]bool)
+	for _, r := range records {
+		applied[r.Id] = true
+	}
+	for _, m := range migrations {
+		if applied[m.Id] {
+			info.Version = m.Id
+		} else {
+			info.Pending = append(info.Pending, m.Id)
+		}
+	}
+
+	const sql = `SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema()`
+	var columns []struct {
+		Table  string `db:"table_name"`
+		Column string `db:"column_name"`
+	}
+	if err := c.db.Select(&columns, sql); err != nil {
+		return nil, err
+	}
+
+	exists := make(map[[2]string]bool)
+	for _, col := range columns {
+		exists[[2]string{col.Table, ""}] = true
+		exists[[2]string{col.Table, col.Column}] = true
+	}
+	for name, feature := range schemaFeatures {
+		info.Features[name] = exists[feature]
+	}
+
+	return info, nil
+}
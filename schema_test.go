@@ -0,0 +1,42 @@
+package conveyor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestVerifySchema(t *testing.T) {
+	c := newConveyor(t)
+	assert.NoError(t, VerifySchema(c.db))
+
+	c.db.MustExec(`DROP INDEX unique_build`)
+	assert.EqualError(t, VerifySchema(c.db), "schema is missing required indexes: unique_build")
+}
+
+func TestConveyor_SchemaInfo(t *testing.T) {
+	c := newConveyor(t)
+
+	migrations, err := Migrations.FindMigrations()
+	assert.NoError(t, err)
+
+	info, err := c.SchemaInfo(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, migrations[len(migrations)-1].Id, info.Version)
+	assert.Equal(t, 0, len(info.Pending))
+	assert.Equal(t, map[string]bool{
+		"failure_reasons":  true,
+		"idempotency_keys": true,
+		"retries":          true,
+		"build_artifacts":  true,
+	}, info.Features)
+
+	c.db.MustExec(`DROP TABLE build_artifacts`)
+	c.db.MustExec(`DELETE FROM gorp_migrations WHERE id = '7_build_artifacts.sql'`)
+
+	info, err = c.SchemaInfo(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"7_build_artifacts.sql"}, info.Pending)
+	assert.False(t, info.Features["build_artifacts"])
+}
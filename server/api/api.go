@@ -113,7 +113,9 @@ func newBuild(b *conveyor.Build) schema.Build {
 	}
 }
 
-// BuildCreate creates a Build and returns it.
+// BuildCreate creates a Build and returns it. Clients can provide an
+// Idempotency-Key header to safely retry the request without creating a
+// duplicate build.
 func (s *Server) BuildCreate(w http.ResponseWriter, r *http.Request) {
 	ctx := context.TODO()
 
@@ -124,9 +126,10 @@ func (s *Server) BuildCreate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	b, err := s.client.Build(ctx, conveyor.BuildRequest{
-		Repository: req.Repository,
-		Branch:     emptyString(req.Branch),
-		Sha:        emptyString(req.Sha),
+		Repository:     req.Repository,
+		Branch:         emptyString(req.Branch),
+		Sha:            emptyString(req.Sha),
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
 	})
 	if err != nil {
 		encodeErr(w, err)
@@ -65,6 +65,33 @@ func TestServer_BuildCreate(t *testing.T) {
 	c.AssertExpectations(t)
 }
 
+func TestServer_BuildCreate_IdempotencyKey(t *testing.T) {
+	c := new(mockConveyor)
+	s := newServer(c, nullAuth)
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/builds", strings.NewReader(`{
+  "repository": "remind101/acme-inc",
+  "sha": "139759bd61e98faeec619c45b1060b4288952164"
+}`))
+	req.Header.Set("Idempotency-Key", "abcd")
+
+	c.On("Build", conveyor.BuildRequest{
+		Repository:     "remind101/acme-inc",
+		Sha:            "139759bd61e98faeec619c45b1060b4288952164",
+		IdempotencyKey: "abcd",
+	}).Return(&conveyor.Build{
+		ID:         fakeUUID,
+		Repository: "remind101/acme-inc",
+		Sha:        "139759bd61e98faeec619c45b1060b4288952164",
+	}, nil)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	c.AssertExpectations(t)
+}
+
 func TestServer_BuildInfo(t *testing.T) {
 	c := new(mockConveyor)
 	s := newServer(c, nullAuth)
@@ -87,6 +87,10 @@ func (s *Server) Push(w http.ResponseWriter, r *http.Request) {
 
 	// Enqueue the build
 	b, err := s.client.Build(ctx, opts)
+	if err == conveyor.ErrBranchForbidden {
+		io.WriteString(w, "Not building forbidden branch")
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -97,6 +97,33 @@ func TestServer_Push_Deleted(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.Code)
 }
 
+func TestServer_Push_Forbidden(t *testing.T) {
+	c := new(mockConveyor)
+	s := newServer(c)
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{
+  "ref": "refs/heads/gh-pages",
+  "head_commit": {
+    "id": "abcd"
+  },
+  "repository": {
+    "full_name": "remind101/acme-inc"
+  }
+}`))
+	req.Header.Set("X-GitHub-Event", "push")
+
+	c.On("Build", conveyor.BuildRequest{
+		Repository: "remind101/acme-inc",
+		Branch:     "gh-pages",
+		Sha:        "abcd",
+	}).Return((*conveyor.Build)(nil), conveyor.ErrBranchForbidden)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "Not building forbidden branch", resp.Body.String())
+}
+
 func TestNoCache(t *testing.T) {
 	tests := []struct {
 		in  string